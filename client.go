@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,12 +30,26 @@ const (
 )
 
 const (
-	MODE_CLIENT = "Client"
-	MODE_SERVER = "Server"
-	MODE_MENU   = "Menu"
+	MODE_CLIENT  = "Client"
+	MODE_SERVER  = "Server"
+	MODE_MENU    = "Menu"
+	MODE_DRY_RUN = "DryRun"
+	MODE_AGENT   = "Agent"
 )
 
 func main() {
+	// options can be anywhere, they are taken out so that the other arguments keep their positions
+	args := os.Args[:1]
+	for _, arg := range os.Args[1:] {
+		switch arg {
+		case "--rehash":
+			moduls.ForceRehash = true
+		default:
+			args = append(args, arg)
+		}
+	}
+	os.Args = args
+
 	if len(os.Args)-1 < 3 {
 		moduls.PrintError("Wrong console arguments")
 		printHelp()
@@ -44,6 +59,20 @@ func main() {
 	// init params and create merkel tree
 	myPeer, port, dirPath := readConfig("config")
 
+	if MODE_DRY_RUN == os.Args[MODE_IDX] {
+		if len(moduls.Shares) > 0 {
+			moduls.DryRunShares(moduls.Shares)
+		} else {
+			moduls.DryRun(dirPath)
+		}
+		return
+	}
+
+	if MODE_AGENT == os.Args[MODE_IDX] {
+		runAgent()
+		return
+	}
+
 	// Create TCP client
 	transport := &*http.DefaultTransport.(*http.Transport)
 	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
@@ -52,7 +81,25 @@ func main() {
 		Timeout:   TIMEOUT,
 	}
 
-	moduls.GenerateKeys()
+	if !loadIdentity() {
+		return
+	}
+	// keys of the peers, to check what they sign
+	moduls.FetchPeerKey = func(peer string) ([]byte, error) {
+		return moduls.PeerKey(client, peer)
+	}
+
+	if moduls.CacheDir != "" {
+		cache, err := moduls.OpenDatumCache(moduls.CacheDir, moduls.CacheMaxSize)
+		moduls.HandlePanicError(err, "Datum cache disabled")
+		moduls.Cache = cache
+	}
+
+	if moduls.SnapshotMode {
+		snapshots, err := moduls.OpenSnapshots()
+		moduls.HandlePanicError(err, "Snapshot mode disabled")
+		moduls.Snapshots = snapshots
+	}
 
 	if MODE_CLIENT == os.Args[MODE_IDX] {
 		processClient(client)
@@ -65,23 +112,19 @@ func main() {
 
 		moduls.HandlePanicError(err, "[ERROR]: err resolving address ")
 
-		//	conn, err := net.ListenUDP("udp", addr)
-		//	if moduls.LOG_PRINT_DATA {
-		//		fmt.Printf("Listening on port %s", port)
-		//	}
-		//
 		serverStringAddr := GetServerAdresses(client)[0]
 
 		fmt.Println(serverStringAddr)
 
-		// Create UDP connection with server
 		serverAddr, err := net.ResolveUDPAddr("udp", serverStringAddr)
 		moduls.HandleFatalError(err, "ResolveUDPAddr failure")
 
-		serverConn, err := net.DialUDP("udp", addr, serverAddr)
-		moduls.HandleFatalError(err, "DialUDP failure")
+		// One socket, not connected, for the server and the peers:
+		// peers reach us at the address the server saw during registration
+		serverConn, err := net.ListenUDP("udp", addr)
+		moduls.HandleFatalError(err, "ListenUDP failure")
 
-		root := moduls.Merkelify(dirPath)
+		root := publish(dirPath)
 		fmt.Printf("my root: name %s, type %d, offset %d, hash %v, children %v\n",
 			root.Name,
 			root.NodeType,
@@ -89,35 +132,23 @@ func main() {
 			root.Hash,
 			root.Children)
 
-		moduls.RegistrationOnServer(serverConn, myPeer, &root)
+		moduls.RegistrationOnServer(serverConn, serverAddr, myPeer, &root)
 
-		timePing := time.Now()
+		// from now on the requests of peers are answered while the root is announced on the same socket
+		moduls.ServeIncoming(serverConn, myPeer)
 
-		buffer := make([]byte, moduls.DATAGRAM_SIZE)
+		watcher := moduls.WatchShare(root)
 
-		for {
-			if time.Now().Sub(timePing) >= 10*time.Second {
-				moduls.MaintainConnectionServer(serverConn, &root)
-				timePing = time.Now()
-			}
+		ping := time.NewTicker(10 * time.Second)
 
-			serverConn.SetReadDeadline(time.Now().Add(TIMEOUT)) // set Timeout
-
-			l, remoteAddr, err := serverConn.ReadFromUDP(buffer)
-
-			if err != nil {
-				if e, ok := err.(net.Error); !ok || !e.Timeout() {
-					moduls.HandlePanicError(err, fmt.Sprintf("[ERROR] reading message from %s: ", remoteAddr))
-				} else if e.Timeout() {
-					//fmt.Printf("Timeout ...\n")
-				}
-			}
-			if l > 0 {
-				fmt.Printf("Receive request %d from %v\n",
-					l,
-					remoteAddr)
-				moduls.ReplyToIncoming(serverConn, remoteAddr, buffer, moduls.Root, myPeer)
+		for {
+			select {
+			case root = <-watcher.Changed():
+				// announce the new root as soon as the share changed
+				ping.Reset(10 * time.Second)
+			case <-ping.C:
 			}
+			moduls.MaintainConnectionServer(serverConn, serverAddr, &root)
 		}
 	} else if MODE_MENU == os.Args[MODE_IDX] {
 
@@ -136,7 +167,7 @@ func main() {
 		serverConn, err := net.DialUDP("udp", nil, serverAddr)
 		moduls.HandleFatalError(err, "DialUDP failure")
 
-		root := moduls.Merkelify(dirPath)
+		root := publish(dirPath)
 		fmt.Printf("my root: name %s, type %d, offset %d, hash %v, children %v\n",
 			root.Name,
 			root.NodeType,
@@ -144,18 +175,23 @@ func main() {
 			root.Hash,
 			root.Children)
 
-		go moduls.MaintainConnectionServer(serverConn, &root)
+		// one goroutine announces every root: the exchanges with the server read the same socket
+		watcher := moduls.WatchShare(root)
+		go func() {
+			moduls.MaintainConnectionServer(serverConn, nil, &root)
+			for root := range watcher.Changed() {
+				moduls.MaintainConnectionServer(serverConn, nil, &root)
+			}
+		}()
 
 		reader := bufio.NewReader(os.Stdin)
 		go menu(reader, client)
 
 		for {
-			root = moduls.Merkelify(dirPath)
-
 			buffer := make([]byte, moduls.DATAGRAM_SIZE)
-			_, remoteAddr, err := conn.ReadFromUDP(buffer)
+			l, remoteAddr, err := conn.ReadFromUDP(buffer)
 			moduls.HandlePanicError(err, fmt.Sprintf("[ERROR] reading message from %s: ", remoteAddr))
-			moduls.ReplyToIncoming(conn, remoteAddr, buffer, root, myPeer)
+			moduls.ReplyToIncoming(conn, remoteAddr, buffer[:l], myPeer)
 
 		}
 
@@ -182,9 +218,28 @@ func processClient(client *http.Client) {
 
 		fmt.Printf("Peer {%s} info\n", os.Args[PEER_IDX])
 		fmt.Printf(" addresses %v\n", moduls.PeerAddr(client, os.Args[PEER_IDX]))
-		fmt.Printf(" key %s\n", hex.EncodeToString(moduls.PeerKey(client, os.Args[PEER_IDX])))
+		if key, err := moduls.PeerKey(client, os.Args[PEER_IDX]); err != nil {
+			moduls.PrintError(err.Error())
+		} else {
+			fmt.Printf(" key %s\n", hex.EncodeToString(key))
+		}
 		fmt.Printf(" root %s\n", hex.EncodeToString(moduls.PeerRoot(client, os.Args[PEER_IDX])))
 
+	case "KnownPeers":
+		printKnownPeers()
+
+	case "Trust", "Forget":
+		if len(os.Args)-1 < 5 {
+			moduls.PrintError("Wrong console arguments")
+			printHelp()
+			return
+		}
+		if os.Args[CMD_IDX] == "Trust" {
+			trustPeer(client, os.Args[PEER_IDX])
+		} else {
+			forgetPeer(os.Args[PEER_IDX])
+		}
+
 	case "HashesInfo", "DownloadHash", "DownloadPath":
 		if len(os.Args)-1 < 5 {
 			moduls.PrintError("Wrong console arguments")
@@ -200,9 +255,8 @@ func processClient(client *http.Client) {
 		moduls.HandleFatalError(err, "DialUDP server failure")
 
 		//========= Register on Server
-		servPublicKey := moduls.RegistrationOnServer(conn, os.Args[PEER_NAME_IDX], nil) // empty dirpath = sharing nothing
+		servPublicKey := moduls.RegistrationOnServer(conn, nil, os.Args[PEER_NAME_IDX], nil) // empty dirpath = sharing nothing
 		fmt.Printf("Connected to server { %s }\n - Public key : %v\n", os.Args[SERVER_NAME_IDX], servPublicKey)
-		moduls.KeyServer = moduls.ParcePublicKay(servPublicKey)
 
 		//========= Create UDP connection with peer
 		peerAdresses := moduls.PeerAddr(client, os.Args[PEER_IDX])
@@ -210,7 +264,18 @@ func processClient(client *http.Client) {
 
 		rootPeer := moduls.PeerRoot(client, os.Args[PEER_IDX])
 
-		moduls.KeyPeer = moduls.ParcePublicKay(moduls.PeerKey(client, os.Args[PEER_IDX]))
+		// a key the server gives must be the pinned one; if it can't be asked, the pinned key still holds
+		peerKey, err := moduls.PeerKey(client, os.Args[PEER_IDX])
+		if err == nil {
+			peerKey, err = moduls.PinPeerKey(os.Args[PEER_IDX], peerKey)
+		} else {
+			moduls.UnexpectedMessage(fmt.Sprintf("%v, keeping the pinned key", err))
+			peerKey, err = moduls.PinnedPeerKey(os.Args[PEER_IDX])
+		}
+		if err != nil {
+			moduls.PrintError(fmt.Sprintf("Not connecting to peer { %s }: %v", os.Args[PEER_IDX], err))
+			return
+		}
 
 		addrPeer, err := net.ResolveUDPAddr("udp", peerAdresses[0])
 		moduls.HandleFatalError(err, "ResolveUDPAddr failure")
@@ -225,7 +290,7 @@ func processClient(client *http.Client) {
 		}
 
 		if "HashesInfo" == os.Args[CMD_IDX] {
-			DataObj := moduls.DataObject{moduls.OP_PRINT_HASH, moduls.NODE_UNKNOWN, "", "/", "", ".", nil}
+			DataObj := moduls.DataObject{Op: moduls.OP_PRINT_HASH, Type: moduls.NODE_UNKNOWN, Path: "/", HddPath: ".", Peer: os.Args[PEER_IDX]}
 			moduls.DownloadData(connPeer, rootPeer, os.Args[PEER_NAME_IDX], &DataObj)
 
 		} else {
@@ -247,14 +312,16 @@ func processClient(client *http.Client) {
 					moduls.PrintError("Decoding hash error")
 					return
 				}
-				DataObj := moduls.DataObject{moduls.OP_DOWNLOAD_HASH, moduls.NODE_UNKNOWN, "", "", "", outputDir, nil}
+				DataObj := moduls.DataObject{Op: moduls.OP_DOWNLOAD_HASH, Type: moduls.NODE_UNKNOWN, HddPath: outputDir, Peer: os.Args[PEER_IDX]}
 				moduls.DownloadData(connPeer, hash, os.Args[PEER_NAME_IDX], &DataObj)
 			} else { //Download path
-				DataObj := moduls.DataObject{moduls.OP_DOWNLOAD_PATH, moduls.NODE_UNKNOWN, "", "/", os.Args[REMOTE_PATH_IDX], outputDir, nil}
+				DataObj := moduls.DataObject{Op: moduls.OP_DOWNLOAD_PATH, Type: moduls.NODE_UNKNOWN, Path: "/", SearchPath: os.Args[REMOTE_PATH_IDX], HddPath: outputDir, Peer: os.Args[PEER_IDX]}
 				moduls.DownloadData(connPeer, rootPeer, os.Args[PEER_NAME_IDX], &DataObj)
 			}
 		}
 
+		moduls.CloseTransactions(connPeer)
+		connPeer.Close()
 		conn.Close()
 
 	default:
@@ -266,11 +333,17 @@ func processClient(client *http.Client) {
 
 func printHelp() {
 	fmt.Print("usage:\n")
-	fmt.Print("go client.go ServerName MyPeerName Mode [... extra parameters]:\n")
-	fmt.Print("  Mode: can have 3 values: Client, Server, Menu\n")
+	fmt.Print("go client.go ServerName MyPeerName Mode [... extra parameters] [--rehash]:\n")
+	fmt.Print("  --rehash: hash all shared files again instead of reusing the hash cache\n")
+	fmt.Print("  Mode: can have 5 values: Client, Server, Menu, DryRun, Agent\n")
 	fmt.Print("For **Client** mode next operations are avalable:\n")
 	fmt.Print("  ServerInfo - display on the screen list of the peers, address, keys, root\n")
 	fmt.Print("  PeerInfo - display on the screen list of the peers, address, keys, root\n")
+	fmt.Print("  KnownPeers - display on the screen the keys pinned for the peers\n")
+	fmt.Print("  Trust - pin the key the server now gives for a peer, replacing the pinned one\n")
+	fmt.Print("   Example: go client.go ServerName MyPeerName Client Trust Peer\n")
+	fmt.Print("  Forget - remove the key pinned for a peer: the next one seen will be pinned\n")
+	fmt.Print("   Example: go client.go ServerName MyPeerName Client Forget Peer\n")
 	fmt.Print("  HashesInfo - display on the screen hashes and associated names\n")
 	fmt.Print("  DownloadHash - download data by hash\n")
 	fmt.Print("   Example: go client.go ServerName MyPeerName Client DownloadHash Peer HASH DownloadDir\n")
@@ -285,6 +358,9 @@ func printHelp() {
 	fmt.Print("For **Server** mode next operations are avalable:\n")
 	fmt.Print("  TODO\n")
 	fmt.Print("For **Menu** there is no extra parameters\n")
+	fmt.Print("For **DryRun** there is no extra parameters: it prints what Server mode would publish and its root hash\n")
+	fmt.Print("For **Agent** there is no extra parameters: it holds the key of key= and signs for the other modes\n")
+	fmt.Print("  through the socket of agent= in config, so they never read the key themselves\n")
 }
 
 // name says it all
@@ -299,7 +375,7 @@ func readConfig(filename string) (name string, port string, dirPath string) {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		splitLine := strings.Split(line, "=")
+		splitLine := strings.SplitN(line, "=", 2)
 
 		if len(splitLine) != 2 {
 			continue
@@ -313,6 +389,86 @@ func readConfig(filename string) (name string, port string, dirPath string) {
 			port = splitLine[1]
 		case "path":
 			dirPath = splitLine[1]
+		case "share":
+			share := strings.SplitN(splitLine[1], "=", 2)
+			if len(share) != 2 {
+				moduls.PanicMessage("share in config file must be share=name=path")
+				continue
+			}
+			moduls.HandlePanicError(moduls.AddShare(share[0], share[1]), "config file")
+		case "window":
+			window, err := strconv.Atoi(splitLine[1])
+			if err != nil || window < 1 {
+				moduls.PanicMessage("window in config file must be a positive number")
+				continue
+			}
+			moduls.DownloadWindow = window
+		case "cache":
+			if splitLine[1] == "none" {
+				moduls.CacheDir = ""
+			} else {
+				moduls.CacheDir = splitLine[1]
+			}
+		case "cache_size":
+			size, err := strconv.ParseInt(splitLine[1], 10, 64)
+			if err != nil || size < 0 {
+				moduls.PanicMessage("cache_size in config file must be a number of MB")
+				continue
+			}
+			moduls.CacheMaxSize = size << 20
+		case "hash_workers":
+			workers, err := strconv.Atoi(splitLine[1])
+			if err != nil || workers < 1 {
+				moduls.PanicMessage("hash_workers in config file must be a positive number")
+				continue
+			}
+			moduls.HashWorkers = workers
+		case "exclude":
+			moduls.ExcludePatterns = append(moduls.ExcludePatterns, splitLine[1])
+		case "snapshot":
+			moduls.SnapshotMode = splitLine[1] == "on"
+		case "snapshot_size":
+			size, err := strconv.ParseInt(splitLine[1], 10, 64)
+			if err != nil || size < 0 {
+				moduls.PanicMessage("snapshot_size in config file must be a number of MB")
+				continue
+			}
+			moduls.SnapshotMaxSize = size << 20
+		case "symlinks":
+			policy, ok := map[string]int{
+				"skip":   moduls.SYMLINKS_SKIP,
+				"share":  moduls.SYMLINKS_IN_SHARE,
+				"follow": moduls.SYMLINKS_FOLLOW,
+			}[splitLine[1]]
+			if !ok {
+				moduls.PanicMessage("symlinks in config file must be skip, share or follow")
+				continue
+			}
+			moduls.SymlinkPolicy = policy
+		case "known_peers":
+			if splitLine[1] == "none" {
+				moduls.KnownPeersFile = ""
+			} else {
+				moduls.KnownPeersFile = splitLine[1]
+			}
+		case "signatures":
+			moduls.StrictSignatures = splitLine[1] == "strict"
+		case "encryption":
+			moduls.EncryptSessions = splitLine[1] == "on"
+		case "key":
+			if splitLine[1] == "none" {
+				moduls.IdentityFile = ""
+			} else {
+				moduls.IdentityFile = splitLine[1]
+			}
+		case "agent":
+			moduls.AgentSocket = splitLine[1]
+		case "state":
+			if splitLine[1] == "none" {
+				moduls.StateDir = ""
+			} else {
+				moduls.StateDir = splitLine[1]
+			}
 
 		}
 	}
@@ -320,10 +476,64 @@ func readConfig(filename string) (name string, port string, dirPath string) {
 	if len(name) == 0 || len(port) == 0 {
 		moduls.PanicMessage("missing params in config file")
 	}
+	if len(moduls.Shares) > 0 && len(dirPath) > 0 {
+		moduls.UnexpectedMessage("path in config file ignored: the shares are published")
+	}
 
 	return name, port, dirPath
 }
 
+// Load the identity key named in config, or make one for this run only if there is none.
+// With an agent in config, the key stays in the agent: we only get its public key.
+// Return: false if the key file or the agent can't be used
+func loadIdentity() bool {
+	var id *moduls.Identity
+	var err error
+	if moduls.AgentSocket != "" {
+		id, err = moduls.AgentIdentity(moduls.AgentSocket)
+	} else if moduls.IdentityFile == "" {
+		id, err = moduls.NewIdentity()
+	} else {
+		id, err = moduls.LoadIdentity(moduls.IdentityFile)
+	}
+	if err != nil {
+		moduls.PrintError(fmt.Sprintf("Identity key: %v", err))
+		return false
+	}
+	moduls.UseIdentity(id)
+	fmt.Printf("Identity key %s\n", hex.EncodeToString(id.PublicKey()))
+	return true
+}
+
+// Hold the identity key named in config and sign for the other modes through the agent socket, until killed
+func runAgent() {
+	if moduls.AgentSocket == "" || moduls.IdentityFile == "" {
+		moduls.PrintError("Agent mode needs agent= and key= in config file")
+		return
+	}
+	id, err := moduls.LoadIdentity(moduls.IdentityFile)
+	if err != nil {
+		moduls.PrintError(fmt.Sprintf("Identity key: %v", err))
+		return
+	}
+	listener, err := moduls.ListenAgent(moduls.AgentSocket)
+	if err != nil {
+		moduls.PrintError(fmt.Sprintf("Agent: %v", err))
+		return
+	}
+	defer listener.Close()
+	fmt.Printf("Agent for identity key %s listening on %s\n", hex.EncodeToString(id.PublicKey()), moduls.AgentSocket)
+	moduls.HandlePanicError(moduls.ServeAgent(listener, id), "Agent")
+}
+
+// Build and serve the tree published by config: its shares if it has some, its path otherwise
+func publish(dirPath string) moduls.Node {
+	if len(moduls.Shares) > 0 {
+		return moduls.MerkelifyShares(moduls.Shares)
+	}
+	return moduls.Merkelify(dirPath)
+}
+
 func menu(reader *bufio.Reader, client *http.Client) {
 
 	// TODO p -d interactions(?) after first request
@@ -336,6 +546,9 @@ Options:
 	p -k: shows p's public key (if it has one)
 	p -r: shows p's root hash
 	p -d: prompt to ask for hash to request from peer p
+	known: lists the keys pinned for the peers
+	p -t: pins the key the server now gives for p
+	p -f: forgets the key pinned for p
 	files: (on hold)
 	exit: exits
 =>`)
@@ -352,9 +565,12 @@ Options:
 			fmt.Printf("%s 's addresses : \n", peer)
 			fmt.Println(addrs)
 		case 2:
-			key := moduls.PeerKey(client, peer)
-			fmt.Printf("%s 's key : \n", peer)
-			fmt.Println(key)
+			if key, err := moduls.PeerKey(client, peer); err != nil {
+				moduls.PrintError(err.Error())
+			} else {
+				fmt.Printf("%s 's key : \n", peer)
+				fmt.Println(key)
+			}
 		case 3:
 			root := moduls.PeerRoot(client, peer)
 			fmt.Printf("%s 's root hash : \n", peer)
@@ -367,6 +583,12 @@ Options:
 			reader.Discard(reader.Buffered())
 		case 5:
 			return
+		case 6:
+			printKnownPeers()
+		case 7:
+			trustPeer(client, peer)
+		case 8:
+			forgetPeer(peer)
 		default:
 			fmt.Println("Unkown command please retry ")
 		}
@@ -383,7 +605,12 @@ func parseCmd(cmd string) (ret int, peer string) {
 		return 0, ""
 	case "exit":
 		return 5, ""
+	case "known":
+		return 6, ""
 	default:
+		if len(split) < 2 {
+			return -1, ""
+		}
 		switch split[1] {
 		case "a":
 			return 1, split[0]
@@ -393,11 +620,51 @@ func parseCmd(cmd string) (ret int, peer string) {
 			return 3, split[0]
 		case "d":
 			return 4, split[0]
+		case "t":
+			return 7, split[0]
+		case "f":
+			return 8, split[0]
 		}
 	}
 	return -1, ""
 }
 
+// Print the keys pinned in the known_peers file
+func printKnownPeers() {
+	lines, err := moduls.KnownPeers()
+	if err != nil {
+		moduls.PrintError(fmt.Sprintf("known_peers: %v", err))
+		return
+	}
+	if len(lines) == 0 {
+		fmt.Printf("No key pinned in %s\n", moduls.KnownPeersFile)
+		return
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+// Pin the key the server gives now for peer
+func trustPeer(client *http.Client, peer string) {
+	key, err := moduls.PeerKey(client, peer)
+	if err == nil {
+		err = moduls.TrustPeerKey(peer, key)
+	}
+	if err != nil {
+		moduls.PrintError(fmt.Sprintf("Trust: %v", err))
+		return
+	}
+	fmt.Printf("Key of peer %s pinned: %x\n", peer, key)
+}
+
+// Remove the key pinned for peer
+func forgetPeer(peer string) {
+	if err := moduls.ForgetPeerKey(peer); err != nil {
+		moduls.PrintError(fmt.Sprintf("Forget: %v", err))
+		return
+	}
+	fmt.Printf("Key of peer %s forgotten\n", peer)
+}
+
 // Get addresses of server
 func GetServerAdresses(tcpClient *http.Client) []string {
 	res, _ := moduls.SendGetRequest(tcpClient, "https://jch.irif.fr:8443/peers/jch.irif.fr/addresses")
@@ -0,0 +1,207 @@
+package moduls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Unix socket of the key agent (set by "agent=" in config).
+// Agent mode serves the identity key on it; the other modes then sign through it
+// and never read the key file, so the private key stays in the agent's memory only.
+var AgentSocket = ""
+
+// Requests to the agent, and status of its replies.
+// Request: op (1 byte) | length (2 bytes) | payload
+// Reply: status (1 byte) | length (2 bytes) | public key, signature (ASN.1) or error text
+const (
+	AGENT_PUBLIC_KEY = 1 // no payload, replied with the key (64 bytes)
+	AGENT_SIGN       = 2 // payload: SHA-256 digest of the data to sign
+
+	AGENT_OK    = 0
+	AGENT_ERROR = 1
+
+	AGENT_MAX_PAYLOAD = 1024
+	AGENT_TIMEOUT     = 5 * time.Second
+)
+
+// Signer whose key is held by an agent, reached through a Unix socket.
+// Requests are serialised on one connection, opened again if it breaks.
+type AgentSigner struct {
+	socket string
+	public *ecdsa.PublicKey
+
+	mutex sync.Mutex
+	conn  net.Conn // nil until the next request if the previous one failed
+}
+
+// Connect to the agent at socket and get its public key
+func DialAgent(socket string) (*AgentSigner, error) {
+	a := &AgentSigner{socket: socket}
+	key, err := a.request(AGENT_PUBLIC_KEY, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != KEY_SIZE {
+		return nil, fmt.Errorf("agent %s: public key of %d bytes", socket, len(key))
+	}
+	public := ParcePublicKay(key)
+	a.public = &public
+	return a, nil
+}
+
+// Identity whose key is held by the agent at socket
+func AgentIdentity(socket string) (*Identity, error) {
+	signer, err := DialAgent(socket)
+	if err != nil {
+		return nil, err
+	}
+	return SignerIdentity(signer, socket)
+}
+
+// Public key of the agent, for crypto.Signer
+func (a *AgentSigner) Public() crypto.PublicKey {
+	return a.public
+}
+
+// Signature of digest (SHA-256) by the agent, in ASN.1 as ecdsa.PrivateKey.Sign gives it, for crypto.Signer
+func (a *AgentSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 || len(digest) != crypto.SHA256.Size() {
+		return nil, fmt.Errorf("agent %s: only SHA-256 digests are signed", a.socket)
+	}
+	return a.request(AGENT_SIGN, digest)
+}
+
+// Send a request to the agent and read its reply, connecting again once if the connection broke
+func (a *AgentSigner) request(op byte, payload []byte) ([]byte, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if a.conn == nil {
+			if a.conn, err = net.DialTimeout("unix", a.socket, AGENT_TIMEOUT); err != nil {
+				a.conn = nil
+				return nil, fmt.Errorf("agent %s: %w", a.socket, err)
+			}
+		}
+		var status byte
+		var reply []byte
+		a.conn.SetDeadline(time.Now().Add(AGENT_TIMEOUT))
+		if err = writeAgentFrame(a.conn, op, payload); err == nil {
+			status, reply, err = readAgentFrame(a.conn)
+		}
+		if err != nil {
+			a.conn.Close()
+			a.conn = nil
+			continue
+		}
+		if status != AGENT_OK {
+			return nil, fmt.Errorf("agent %s: %s", a.socket, reply)
+		}
+		return reply, nil
+	}
+	return nil, fmt.Errorf("agent %s: %w", a.socket, err)
+}
+
+// Listen for clients of the agent at socket, readable and writable by us only.
+// A socket left by an agent that stopped is replaced.
+func ListenAgent(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("agent %s: exists and is not a socket", socket)
+		}
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("agent %s: another agent is running", socket)
+		}
+		os.Remove(socket)
+	}
+	return listenPrivate(socket)
+}
+
+// Answer the requests of the clients of listener with the key of id, until listener is closed
+func ServeAgent(listener net.Listener, id *Identity) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go serveAgentConn(conn, id)
+	}
+}
+
+// Answer the requests of one client until it disconnects
+func serveAgentConn(conn net.Conn, id *Identity) {
+	defer conn.Close()
+	for {
+		op, payload, err := readAgentFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				HandlePanicError(err, "agent: request")
+			}
+			return
+		}
+
+		status, reply := byte(AGENT_OK), []byte(nil)
+		switch op {
+		case AGENT_PUBLIC_KEY:
+			reply = id.PublicKey()
+		case AGENT_SIGN:
+			reply, err = id.signer.Sign(rand.Reader, payload, crypto.SHA256)
+		default:
+			err = fmt.Errorf("unknown request %d", op)
+		}
+		if err != nil {
+			status, reply = AGENT_ERROR, []byte(err.Error())
+		}
+		if err := writeAgentFrame(conn, status, reply); err != nil {
+			HandlePanicError(err, "agent: reply")
+			return
+		}
+	}
+}
+
+// Frame of the agent protocol: kind (op or status) | length (2 bytes) | payload
+func writeAgentFrame(w io.Writer, kind byte, payload []byte) error {
+	if len(payload) > AGENT_MAX_PAYLOAD {
+		return fmt.Errorf("agent frame of %d bytes", len(payload))
+	}
+	frame := make([]byte, 3+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(payload)))
+	copy(frame[3:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readAgentFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[1:3]))
+	if length > AGENT_MAX_PAYLOAD {
+		return 0, nil, fmt.Errorf("agent frame of %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
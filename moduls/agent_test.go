@@ -0,0 +1,93 @@
+package moduls
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Start an agent for id on socket until the end of the test
+func startAgent(t *testing.T, socket string, id *Identity) net.Listener {
+	t.Helper()
+	listener, err := ListenAgent(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeAgent(listener, id)
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// Signatures made through the agent check against the key it holds, across a restart of the agent
+func TestAgentSigns(t *testing.T) {
+	dir := t.TempDir()
+	held, err := LoadIdentity(filepath.Join(dir, "identity.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "agent", "sock")
+	listener := startAgent(t, socket, held)
+
+	id, err := AgentIdentity(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id.PublicKey(), held.PublicKey()) || id.Path() != socket {
+		t.Fatalf("agent gives key %x at %q, holds %x", id.PublicKey(), id.Path(), held.PublicKey())
+	}
+	key := ParcePublicKay(held.PublicKey())
+	sign := func(data string) {
+		t.Helper()
+		sig, err := id.Sign([]byte(data))
+		if err != nil || !CheckSignature([]byte(data), sig, &key) {
+			t.Fatalf("signature of %q through the agent: %v", data, err)
+		}
+	}
+	sign("first")
+	sign("second")
+
+	// the agent stops, its connection with it
+	listener.Close()
+	id.signer.(*AgentSigner).conn.Close()
+	if _, err := id.Sign([]byte("nobody")); err == nil {
+		t.Fatal("signed with the agent stopped")
+	}
+	startAgent(t, socket, held)
+	sign("after a restart")
+}
+
+// An agent doesn't take the place of a running one or of a file, but replaces a socket left behind
+func TestListenAgent(t *testing.T) {
+	dir := t.TempDir()
+	id, _ := NewIdentity()
+
+	running := filepath.Join(dir, "running")
+	startAgent(t, running, id)
+	if _, err := ListenAgent(running); err == nil {
+		t.Error("second agent on the socket of a running one")
+	}
+
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0600)
+	if _, err := ListenAgent(file); err == nil {
+		t.Error("agent on a regular file")
+	}
+
+	stale := filepath.Join(dir, "stale")
+	left, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	left.SetUnlinkOnClose(false)
+	left.Close()
+	startAgent(t, stale, id)
+	info, err := os.Stat(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket with mode %04o, want 0600", perm)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package moduls
+
+import (
+	"net"
+)
+
+// No Unix permissions on this system: the socket is protected by the directory it is in only
+func listenPrivate(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
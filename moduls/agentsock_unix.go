@@ -0,0 +1,17 @@
+//go:build unix
+
+package moduls
+
+import (
+	"net"
+	"syscall"
+)
+
+// Listen on Unix socket, created readable and writable by us only.
+// The umask is set around the bind rather than the socket chmod-ed after it, so no other user can connect in between.
+// It is the umask of the process: files created meanwhile by other goroutines get no permissions for the others either.
+func listenPrivate(socket string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", socket)
+}
@@ -0,0 +1,218 @@
+package moduls
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Where verified datums are kept between runs (can be set by "cache=" in config, "cache=none" disables it)
+var CacheDir = defaultCacheDir()
+
+// Size cap of the cache in bytes (can be set in MB by "cache_size=" in config)
+var CacheMaxSize int64 = 256 << 20
+
+// Cache of datums shared by all downloads, nil if disabled
+var Cache *DatumCache
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "betweenus", "datums")
+}
+
+// Local content-addressed store: hash -> verified datum value, one file per datum named after its hash.
+// When the total size goes over the cap the least recently used datums are evicted.
+// The order of use survives restarts through the modification time of the files.
+type DatumCache struct {
+	dir     string
+	maxSize int64
+
+	mutex   sync.Mutex
+	size    int64
+	entries map[string]*list.Element // hex hash -> element of lru
+	lru     *list.List               // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	hash string // hex
+	size int64
+}
+
+// Open cache in dir, creating it if needed, and index the datums already there
+func OpenDatumCache(dir string, maxSize int64) (*DatumCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &DatumCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+
+	type found struct {
+		hash  string
+		size  int64
+		mtime time.Time
+	}
+	var files []found
+	err := filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return nil
+		}
+		name := de.Name()
+		if len(name) != 2*HASH_SIZE {
+			return nil
+		}
+		if _, err := hex.DecodeString(name); err != nil {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, found{name, info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// oldest first, so the most recently used ends up at the front
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		c.entries[f.hash] = c.lru.PushFront(&cacheEntry{f.hash, f.size})
+		c.size += f.size
+	}
+	c.mutex.Lock()
+	c.evict()
+	c.mutex.Unlock()
+	return c, nil
+}
+
+func (c *DatumCache) filePath(hexHash string) string {
+	return filepath.Join(c.dir, hexHash[:2], hexHash)
+}
+
+// Value of datum with hash, verified again, or nil if not in cache
+func (c *DatumCache) Get(hash []byte) []byte {
+	hexHash := hex.EncodeToString(hash)
+
+	c.mutex.Lock()
+	el, ok := c.entries[hexHash]
+	if !ok {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	c.mutex.Unlock()
+
+	path := c.filePath(hexHash)
+	value, err := os.ReadFile(path)
+	if sum := sha256.Sum256(value); err != nil || !bytes.Equal(sum[:], hash) {
+		// lost or damaged on disk
+		c.mutex.Lock()
+		c.remove(el)
+		c.mutex.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return value
+}
+
+// Is datum with hash in cache (it is not read, nor verified)
+func (c *DatumCache) Has(hash []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.entries[hex.EncodeToString(hash)]
+	return ok
+}
+
+// Store datum whose hash was already checked
+func (c *DatumCache) Put(hash []byte, value []byte) {
+	hexHash := hex.EncodeToString(hash)
+
+	c.mutex.Lock()
+	_, ok := c.entries[hexHash]
+	c.mutex.Unlock()
+	if ok {
+		return
+	}
+
+	path := c.filePath(hexHash)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		HandlePanicError(err, "DatumCache: mkdir")
+		return
+	}
+	// write aside then rename, so a datum is never seen half written
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, value, 0600); err != nil {
+		HandlePanicError(err, "DatumCache: write")
+		os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		HandlePanicError(err, "DatumCache: rename")
+		os.Remove(tmp)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[hexHash]; ok {
+		return
+	}
+	c.entries[hexHash] = c.lru.PushFront(&cacheEntry{hexHash, int64(len(value))})
+	c.size += int64(len(value))
+	c.evict()
+}
+
+// Remove the datums keep doesn't want
+func (c *DatumCache) Retain(keep func(hash []byte) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for hexHash, el := range c.entries {
+		if hash, err := hex.DecodeString(hexHash); err != nil || !keep(hash) {
+			c.remove(el)
+		}
+	}
+}
+
+// Remove least recently used datums until the cache fits in its cap (mutex held)
+func (c *DatumCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// (mutex held)
+func (c *DatumCache) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	if c.entries[e.hash] != el {
+		return
+	}
+	c.lru.Remove(el)
+	delete(c.entries, e.hash)
+	c.size -= e.size
+	os.Remove(c.filePath(e.hash))
+}
+
+// Total size of datums in cache, in bytes
+func (c *DatumCache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
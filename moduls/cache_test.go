@@ -0,0 +1,123 @@
+package moduls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Datum of test cache named by a letter: 100 bytes
+func letterDatum(letter byte) (hash []byte, value []byte) {
+	value = append([]byte{CHUNK}, strings.Repeat(string(letter), 99)...)
+	sum := sha256.Sum256(value)
+	return sum[:], value
+}
+
+func TestDatumCacheEviction(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		ops     string // p<letter>: put, g<letter>: get
+		present string
+		absent  string
+	}{
+		{"under the cap", 300, "papbpc", "abc", ""},
+		{"oldest evicted", 300, "papbpcpd", "bcd", "a"},
+		{"get makes recent", 300, "papbpcgapd", "acd", "b"},
+		{"put again does not duplicate", 300, "papbpapc", "abc", ""},
+		{"several evicted at once", 100, "papbpc", "c", "ab"},
+		{"nothing fits", 50, "pa", "", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := OpenDatumCache(t.TempDir(), tt.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(tt.ops); i += 2 {
+				hash, value := letterDatum(tt.ops[i+1])
+				if tt.ops[i] == 'p' {
+					c.Put(hash, value)
+				} else {
+					c.Get(hash)
+				}
+			}
+			for _, l := range []byte(tt.present) {
+				if hash, _ := letterDatum(l); c.Get(hash) == nil {
+					t.Errorf("%c evicted", l)
+				}
+			}
+			for _, l := range []byte(tt.absent) {
+				if hash, _ := letterDatum(l); c.Get(hash) != nil {
+					t.Errorf("%c still in cache", l)
+				}
+			}
+			if want := int64(100 * len(tt.present)); c.Size() != want {
+				t.Errorf("size %d, want %d", c.Size(), want)
+			}
+		})
+	}
+}
+
+// The order of use survives a restart, and datums damaged on disk are not returned
+func TestDatumCacheReopen(t *testing.T) {
+	dir := t.TempDir()
+	c, err := OpenDatumCache(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range []byte("abcd") {
+		hash, value := letterDatum(l)
+		c.Put(hash, value)
+		// the order of use is kept in the mtime of the files
+		at := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(c.filePath(hex.EncodeToString(hash)), at, at)
+	}
+	hash, _ := letterDatum('c')
+	if err := os.WriteFile(c.filePath(hex.EncodeToString(hash)), []byte("damaged"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		letter byte
+		found  bool
+	}{
+		{'a', false}, // least recently used, evicted by the smaller cap
+		{'b', true},
+		{'c', false}, // damaged
+		{'d', true},
+	}
+	c, err = OpenDatumCache(dir, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		hash, value := letterDatum(tt.letter)
+		got := c.Get(hash)
+		if (got != nil) != tt.found || (got != nil && string(got) != string(value)) {
+			t.Errorf("%c: got %q, want found %v", tt.letter, got, tt.found)
+		}
+	}
+}
+
+// Retain drops every datum keep refuses
+func TestDatumCacheRetain(t *testing.T) {
+	c, err := OpenDatumCache(t.TempDir(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []byte("abc") {
+		c.Put(letterDatum(l))
+	}
+	keep, _ := letterDatum('b')
+	c.Retain(func(hash []byte) bool { return string(hash) == string(keep) })
+	for _, l := range []byte("abc") {
+		hash, _ := letterDatum(l)
+		if found := c.Get(hash) != nil; found != (l == 'b') {
+			t.Errorf("%c found %v after Retain", l, found)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package moduls
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of consecutive NoDatum replies taken as a sign that the peer is overloaded
+const NO_DATUM_STORM = 4
+
+// Initial congestion window (requests in flight) of a download
+const INITIAL_WINDOW = 2
+
+// AIMD congestion control of the GetDatum requests in flight to one peer.
+// The window grows by one per reply while below the slow start threshold, then by one per window of replies,
+// and is halved on loss (a request that had to be re-sent) or on a storm of NoDatum,
+// at most once per round trip so one burst of losses only counts once.
+type CongestionControl struct {
+	mutex     sync.Mutex
+	available *sync.Cond
+	rtt       *RttEstimator
+
+	cwnd      float64
+	ssthresh  float64
+	maxWindow int
+	inFlight  int
+	lastCut   time.Time
+	noDatums  int // consecutive NoDatum
+
+	replies int // requests that got a reply
+	losses  int // transmissions that timed out
+}
+
+func NewCongestionControl(maxWindow int, rtt *RttEstimator) *CongestionControl {
+	if maxWindow < 1 {
+		maxWindow = 1
+	}
+	c := &CongestionControl{
+		rtt:       rtt,
+		cwnd:      INITIAL_WINDOW,
+		ssthresh:  float64(maxWindow),
+		maxWindow: maxWindow,
+	}
+	if c.cwnd > float64(maxWindow) {
+		c.cwnd = float64(maxWindow)
+	}
+	c.available = sync.NewCond(&c.mutex)
+	return c
+}
+
+// Wait until the window allows one more request in flight
+func (c *CongestionControl) Acquire() {
+	c.mutex.Lock()
+	for c.inFlight >= int(c.cwnd) {
+		c.available.Wait()
+	}
+	c.inFlight++
+	c.mutex.Unlock()
+}
+
+// Request finished (with a reply or not)
+func (c *CongestionControl) Release() {
+	c.mutex.Lock()
+	c.inFlight--
+	c.available.Broadcast()
+	c.mutex.Unlock()
+}
+
+// A reply arrived: additive increase
+func (c *CongestionControl) OnReply(noDatum bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.replies++
+	if noDatum {
+		c.noDatums++
+		if c.noDatums >= NO_DATUM_STORM {
+			c.noDatums = 0
+			c.cut()
+		}
+		return
+	}
+	c.noDatums = 0
+
+	if c.cwnd < c.ssthresh {
+		c.cwnd++ // slow start
+	} else {
+		c.cwnd += 1 / c.cwnd
+	}
+	if c.cwnd > float64(c.maxWindow) {
+		c.cwnd = float64(c.maxWindow)
+	}
+	c.available.Broadcast()
+}
+
+// A transmission timed out: multiplicative decrease
+func (c *CongestionControl) OnLoss() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.losses++
+	c.cut()
+}
+
+// Halve the window, unless it was already done during the last round trip
+func (c *CongestionControl) cut() {
+	rtt := c.rtt.Srtt()
+	if rtt == 0 {
+		rtt = c.rtt.Timeout()
+	}
+	if time.Since(c.lastCut) < rtt {
+		return
+	}
+	c.lastCut = time.Now()
+
+	c.ssthresh = c.cwnd / 2
+	if c.ssthresh < 1 {
+		c.ssthresh = 1
+	}
+	c.cwnd = c.ssthresh
+}
+
+// Current window, in requests
+func (c *CongestionControl) Window() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return int(c.cwnd)
+}
+
+// Share of transmissions that were lost
+func (c *CongestionControl) LossRate() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.replies+c.losses == 0 {
+		return 0
+	}
+	return float64(c.losses) / float64(c.replies+c.losses)
+}
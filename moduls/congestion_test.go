@@ -0,0 +1,101 @@
+package moduls
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCongestionWindow(t *testing.T) {
+	six := strings.Repeat("r", 6) // slow start from 2 to 8
+	tests := []struct {
+		name      string
+		maxWindow int
+		events    string // r: reply, n: NoDatum, l: loss, .: a round trip passes
+		window    int
+	}{
+		{"initial", 16, "", INITIAL_WINDOW},
+		{"initial above the maximum", 1, "", 1},
+		{"slow start", 16, "r", 3},
+		{"slow start up to the maximum", 16, strings.Repeat("r", 20), 16},
+		{"loss halves", 16, six + "l", 4},
+		{"burst of losses in one round trip", 16, six + "lll", 4},
+		{"losses in two round trips", 16, six + "l.l", 2},
+		{"never below one", 16, "l.l.l.l", 1},
+		{"congestion avoidance: less than one per reply", 16, six + "l" + "rrrr", 4},
+		{"congestion avoidance: one per window of replies", 16, six + "l" + "rrrrr", 5},
+		{"storm of NoDatum", 16, six + "nnnn", 4},
+		{"NoDatum broken by a datum", 16, six + "nnnrnnn", 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rtt := NewRttEstimator()
+			rtt.Sample(time.Hour) // only the round trips of events pass
+			c := NewCongestionControl(tt.maxWindow, rtt)
+			for _, e := range tt.events {
+				switch e {
+				case 'r':
+					c.OnReply(false)
+				case 'n':
+					c.OnReply(true)
+				case 'l':
+					c.OnLoss()
+				case '.':
+					c.lastCut = time.Time{}
+				}
+			}
+			if c.Window() != tt.window {
+				t.Errorf("window %d after %q, want %d", c.Window(), tt.events, tt.window)
+			}
+		})
+	}
+}
+
+func TestCongestionLossRate(t *testing.T) {
+	tests := []struct {
+		replies int
+		losses  int
+		want    float64
+	}{
+		{0, 0, 0},
+		{3, 1, 0.25},
+		{0, 2, 1},
+	}
+	for _, tt := range tests {
+		c := NewCongestionControl(16, NewRttEstimator())
+		for i := 0; i < tt.replies; i++ {
+			c.OnReply(false)
+		}
+		for i := 0; i < tt.losses; i++ {
+			c.OnLoss()
+		}
+		if got := c.LossRate(); got != tt.want {
+			t.Errorf("%d replies, %d losses: loss rate %v, want %v", tt.replies, tt.losses, got, tt.want)
+		}
+	}
+}
+
+// Acquire waits for a request in flight to finish once the window is full
+func TestCongestionAcquireBlocks(t *testing.T) {
+	c := NewCongestionControl(16, NewRttEstimator())
+	for i := 0; i < INITIAL_WINDOW; i++ {
+		c.Acquire()
+	}
+	acquired := make(chan struct{})
+	go func() {
+		c.Acquire()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("request sent beyond the window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("request still waiting after a release")
+	}
+}
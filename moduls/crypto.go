@@ -1,26 +1,16 @@
 package moduls
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/asn1"
 	"fmt"
 	"math/big"
 )
 
-var KeyServer ecdsa.PublicKey
-var KeyPeer ecdsa.PublicKey
-var MyPrivateKey ecdsa.PrivateKey
-var MyPublicKey ecdsa.PublicKey
-
-// Generate keys
-func GenerateKeys() {
-	MyPrivateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	MyPublicKey, _ := MyPrivateKey.Public().(*ecdsa.PublicKey)
-	fmt.Println(MyPublicKey)
-}
-
 // public key to 64 bytes array
 func FormatPublicKey(publicKey *ecdsa.PublicKey) []byte {
 	formatted := make([]byte, 64)
@@ -48,15 +38,27 @@ func ParcePublicKay(data []byte) ecdsa.PublicKey {
 	return publicKey
 }
 
-// Sign the message
-func SignMessage(data []byte, privateKey *ecdsa.PrivateKey) []byte {
+// Sign the message with signer, which holds a P-256 key: in memory, loaded from a PEM file or in an agent
+// Return: signature of 64 bytes (r and s), as sent after the body
+func SignMessage(data []byte, signer crypto.Signer) ([]byte, error) {
 	hashed := sha256.Sum256(data)
-	r, s, _ := ecdsa.Sign(rand.Reader, privateKey, hashed[:])
+	der, err := signer.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	// ECDSA signers give r and s in ASN.1
+	var rs struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(der, &rs); err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("signature is not an ASN.1 ECDSA signature")
+	}
+	if rs.R.Sign() <= 0 || rs.S.Sign() <= 0 || rs.R.BitLen() > 256 || rs.S.BitLen() > 256 {
+		return nil, fmt.Errorf("signature is not a P-256 signature")
+	}
 	signature := make([]byte, 64)
-	r.FillBytes(signature[:32])
-	s.FillBytes(signature[32:])
+	rs.R.FillBytes(signature[:32])
+	rs.S.FillBytes(signature[32:])
 
-	return signature
+	return signature, nil
 }
 
 // Check the signature of message
@@ -0,0 +1,411 @@
+package moduls
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Maximum number of GetDatum requests kept in flight during a download (can be set by "window=" in config).
+// The actual window is driven by the congestion control below this cap.
+var DownloadWindow = 16
+
+// A file never has more than LOOKAHEAD*window of its fetched chunks waiting in memory to be written
+const LOOKAHEAD = 4
+
+// Files downloaded at the same time: the others wait for their turn before opening their output file,
+// so that a share of many files never runs out of file descriptors
+const MAX_OPEN_FILES = 64
+
+// Statistics of one DownloadData run
+type DownloadStats struct {
+	Datums  int   // number of datums received
+	Reused  int   // number of datums taken from the journal of a previous run
+	Cached  int   // number of datums taken from the local cache
+	Files   int   // number of files written
+	Bytes   int64 // bytes written to files
+	Start   time.Time
+	Elapsed time.Duration
+
+	Window   int     // congestion window at the end of the download
+	LossRate float64 // share of GetDatum transmissions that timed out
+}
+
+// Print statistics and throughput of download
+func (s DownloadStats) Print() {
+	seconds := s.Elapsed.Seconds()
+	if seconds == 0 {
+		seconds = 1e-9
+	}
+	fmt.Printf("Downloaded %d bytes in %d files (%d datums, %d reused, %d from cache) in %.2f s: %.1f KB/s, window %d, loss rate %.1f%%\n",
+		s.Bytes, s.Files, s.Datums, s.Reused, s.Cached, seconds, float64(s.Bytes)/1024/seconds, s.Window, 100*s.LossRate)
+}
+
+// Download engine: walks the tree of a peer fetching the children of every node concurrently,
+// with at most `window` GetDatum in flight on the connection, fewer if congestion control says so
+type downloader struct {
+	conn       *net.UDPConn
+	myPeer     string
+	peer       string // remote peer, for reports
+	window     int
+	congestion *CongestionControl
+	journal    *Journal      // nil when only printing hashes
+	files      chan struct{} // one token per output file open
+
+	mutex sync.Mutex
+	stats DownloadStats
+}
+
+func newDownloader(conn *net.UDPConn, myPeer string, window int) *downloader {
+	if window < 1 {
+		window = 1
+	}
+	return &downloader{
+		conn:       conn,
+		myPeer:     myPeer,
+		window:     window,
+		congestion: NewCongestionControl(window, PeerRtt(conn.RemoteAddr())),
+		files:      make(chan struct{}, MAX_OPEN_FILES),
+		stats:      DownloadStats{Start: time.Now()},
+	}
+}
+
+// Fetch one datum from the journal of a previous run, from the local cache,
+// or from the peer waiting for a free slot of the window
+func (d *downloader) fetch(hash []byte) ([]byte, error) {
+	if d.journal != nil {
+		if value := d.journal.Lookup(hash); value != nil {
+			d.mutex.Lock()
+			d.stats.Reused++
+			d.mutex.Unlock()
+			return value, nil
+		}
+	}
+	if Cache != nil {
+		if value := Cache.Get(hash); value != nil {
+			if d.journal != nil && value[0] != CHUNK {
+				d.journal.AddNode(hash, value)
+			}
+			d.mutex.Lock()
+			d.stats.Cached++
+			d.mutex.Unlock()
+			return value, nil
+		}
+	}
+
+	d.congestion.Acquire()
+	value, err := requestDatum(d.conn, hash, d.myPeer, d.congestion.OnLoss)
+	d.congestion.Release()
+
+	if err == nil || errors.Is(err, ErrNoDatum) {
+		d.congestion.OnReply(err != nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(value) == 0 {
+		return nil, errors.New("empty datum")
+	}
+
+	if d.journal != nil && value[0] != CHUNK {
+		d.journal.AddNode(hash, value)
+	}
+
+	d.mutex.Lock()
+	d.stats.Datums++
+	d.mutex.Unlock()
+	return value, nil
+}
+
+func (d *downloader) written(n int) {
+	d.mutex.Lock()
+	d.stats.Bytes += int64(n)
+	d.mutex.Unlock()
+}
+
+// Download data from hash and create directory structure (files and folders)
+// Parameters:
+// - conn - UDP Connection
+// - hashPeer - hash of peer
+// - myPeer - name of my peer
+// - DataObj - data object, holds information about current file and directory
+// Return: RESULT_OK or RESULT_ERROR
+func DownloadData(conn *net.UDPConn, hashPeer []byte, myPeer string, DataObj *DataObject) int {
+	if LOG_PRINT_DATA {
+		fmt.Printf(">DownloadData(..., %v..., %s, %s, %s)\n", hashPeer[0:32], myPeer, DataObj.Name, DataObj.Path)
+	}
+	d := newDownloader(conn, myPeer, DownloadWindow)
+	d.peer = fmt.Sprintf("%s (%s)", DataObj.Peer, conn.RemoteAddr())
+
+	if DataObj.Op != OP_PRINT_HASH {
+		journal, resumed, err := OpenJournal(DataObj.HddPath, hashPeer, DataObj.Op, DataObj.SearchPath)
+		if err != nil {
+			HandleFatalError(err, "DownloadData, open journal")
+			return RESULT_ERROR
+		}
+		if resumed {
+			fmt.Printf("Resuming interrupted download from journal %s\n", JournalPath(DataObj.HddPath))
+		}
+		d.journal = journal
+	}
+
+	err := d.download(hashPeer, *DataObj, POSITION_ROOT)
+
+	if d.journal != nil {
+		if err == nil {
+			d.journal.Remove()
+		} else {
+			d.journal.Close()
+			fmt.Printf("Download incomplete, run the same command again to resume it\n")
+		}
+	}
+
+	d.stats.Elapsed = time.Since(d.stats.Start)
+	d.stats.Window = d.congestion.Window()
+	d.stats.LossRate = d.congestion.LossRate()
+	if DataObj.Op != OP_PRINT_HASH {
+		d.stats.Print()
+	}
+	if err != nil {
+		HandleFatalError(err, "DownloadData")
+		return RESULT_ERROR
+	}
+	return RESULT_OK
+}
+
+// Download one node of unknown type, and everything below it.
+// A node that is not well formed for its position aborts its subtree only.
+func (d *downloader) download(hash []byte, obj DataObject, position int) error {
+	value, err := d.fetch(hash)
+
+	if obj.Op == OP_PRINT_HASH && position != POSITION_DIR_PART {
+		fmt.Printf("%s <=> %s\n", filepath.Join(obj.Path, obj.Name), hex.EncodeToString(hash))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Join(obj.Path, obj.Name), err)
+	}
+	if err := VerifyNode(value, position); err != nil {
+		return d.badNode(filepath.Join(obj.Path, obj.Name), hash, err)
+	}
+
+	switch value[0] {
+	case CHUNK, BIG_FILE:
+		if obj.Op != OP_DOWNLOAD_HASH {
+			return nil
+		}
+		return d.downloadFile(hash, value, obj)
+	case DIRECTORY:
+		return d.downloadDir(value, obj)
+	default:
+		return fmt.Errorf("%s: unexpected type of node %d", filepath.Join(obj.Path, obj.Name), value[0])
+	}
+}
+
+// Download all entries of directory concurrently.
+// The parts of a split directory are downloaded as the directory itself, so their entries end up in it.
+func (d *downloader) downloadDir(value []byte, obj DataObject) error {
+	peerDirPath := filepath.Join(obj.Path, obj.Name)
+	hddPath := filepath.Join(obj.HddPath, obj.Name)
+
+	entries := ParceValue(value)
+
+	// created even without entries, so empty directories are downloaded too
+	if obj.Op == OP_DOWNLOAD_HASH || (obj.Op == OP_DOWNLOAD_PATH && obj.SearchPath == peerDirPath) {
+		if _, err := os.Stat(hddPath); os.IsNotExist(err) {
+			os.Mkdir(hddPath, 0777)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(entries))
+
+	for i, el := range entries {
+		op := obj.Op
+
+		//if path has been found - start downloading data
+		if op == OP_DOWNLOAD_PATH {
+			filePath := filepath.Join(peerDirPath, el.Name)
+			if obj.SearchPath == peerDirPath || obj.SearchPath == filePath {
+				op = OP_DOWNLOAD_HASH
+			}
+		}
+
+		if op == OP_DOWNLOAD_HASH {
+			if _, err := os.Stat(hddPath); os.IsNotExist(err) {
+				os.Mkdir(hddPath, 0777)
+			}
+		}
+
+		if LOG_PRINT_DATA {
+			fmt.Printf("DownloadData: DIR for content %s of directory %s\n", el.Name, peerDirPath)
+		}
+
+		child := DataObject{Op: op, Type: NODE_UNKNOWN, Name: el.Name, Path: peerDirPath, SearchPath: obj.SearchPath, HddPath: hddPath}
+		position := POSITION_DIR_ENTRY
+		if isSplitDirectory(el.Name) {
+			child = DataObject{Op: op, Type: NODE_UNKNOWN, Name: obj.Name, Path: obj.Path, SearchPath: obj.SearchPath, HddPath: obj.HddPath}
+			position = POSITION_DIR_PART
+		}
+
+		wg.Add(1)
+		go func(i int, hash []byte) {
+			defer wg.Done()
+			errs[i] = d.download(hash, child, position)
+		}(i, el.Hash)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Node of a file being downloaded
+type fileItem struct {
+	hash     []byte
+	fetching bool
+	value    []byte // nil until received
+}
+
+type fetchResult struct {
+	it    *fileItem
+	value []byte
+	err   error
+}
+
+// Download file whose root node (CHUNK or BIG_FILE) is already fetched, once one of the MAX_OPEN_FILES slots is free.
+// Nodes are requested in file order, up to `window` at once; replies arrive in any order.
+// A BIG_FILE node is replaced by its children as soon as it arrives, so the window never stalls on it,
+// and a chunk is written at its offset as soon as the size of everything before it is known.
+func (d *downloader) downloadFile(hash []byte, value []byte, obj DataObject) error {
+	name := obj.Name
+	if name == "" {
+		name = hex.EncodeToString(hash)
+	}
+	filePath := filepath.Join(obj.HddPath, name)
+
+	d.files <- struct{}{}
+	defer func() { <-d.files }()
+
+	// a file partially written by a previous run is kept: its chunks are read back from it
+	flags := os.O_RDWR | os.O_CREATE
+	if d.journal == nil || !d.journal.HasFile(filePath) {
+		flags |= os.O_TRUNC
+	}
+	handle, err := os.OpenFile(filePath, flags, 0755)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	// unwritten part of the file, in order
+	queue := []*fileItem{{hash: hash, fetching: true, value: value}}
+	var offset int64
+
+	// chunks written, to check the file at the end
+	var leaves [][]byte
+	var lengths []int
+
+	results := make(chan fetchResult, d.window)
+	inFlight := 0
+
+	for {
+		// replace received BIG_FILE nodes by their children, write chunks at the head of the file
+		for i := 0; i < len(queue); i++ {
+			it := queue[i]
+			if it.value == nil {
+				continue
+			}
+			switch it.value[0] {
+			case BIG_FILE:
+				children := ParceValue(it.value)[0]
+				items := make([]*fileItem, children.NbHash)
+				for j := range items {
+					items[j] = &fileItem{hash: children.Hash[j*HASH_SIZE : (j+1)*HASH_SIZE]}
+				}
+				queue = append(queue[:i], append(items, queue[i+1:]...)...)
+				i--
+			case CHUNK:
+				if i != 0 {
+					continue
+				}
+				n, err := handle.WriteAt(it.value[1:], offset)
+				if err != nil {
+					d.drain(results, inFlight)
+					return err
+				}
+				if d.journal != nil {
+					d.journal.AddChunk(it.hash, filePath, offset, n)
+				}
+				offset += int64(n)
+				d.written(n)
+				leaves = append(leaves, it.hash)
+				lengths = append(lengths, n)
+				queue = queue[1:]
+				i--
+			default:
+				d.drain(results, inFlight)
+				return fmt.Errorf("%s: unexpected type of node %d inside file", filePath, it.value[0])
+			}
+		}
+
+		if len(queue) == 0 && inFlight == 0 {
+			break
+		}
+
+		// request the next nodes of the window
+		for i := 0; i < len(queue) && i < LOOKAHEAD*d.window && inFlight < d.window; i++ {
+			if queue[i].fetching {
+				continue
+			}
+			queue[i].fetching = true
+			inFlight++
+			go func(it *fileItem) {
+				value, err := d.fetch(it.hash)
+				results <- fetchResult{it, value, err}
+			}(queue[i])
+		}
+
+		res := <-results
+		inFlight--
+		if res.err != nil {
+			d.drain(results, inFlight)
+			return fmt.Errorf("%s: %w", filePath, res.err)
+		}
+		if err := VerifyNode(res.value, POSITION_FILE_PART); err != nil {
+			d.drain(results, inFlight)
+			return d.badNode(filepath.Join(obj.Path, obj.Name), res.it.hash, err)
+		}
+		res.it.value = res.value
+	}
+
+	// drop what remains of a longer previous version of the file
+	if err := handle.Truncate(offset); err != nil {
+		return err
+	}
+	if err := VerifyAssembledFile(filePath, leaves, lengths); err != nil {
+		return fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	d.mutex.Lock()
+	d.stats.Files++
+	d.mutex.Unlock()
+	return nil
+}
+
+// Report node of the peer that is not well formed
+func (d *downloader) badNode(path string, hash []byte, err error) error {
+	e := &StructureError{Peer: d.peer, Path: path, Hash: hash, Err: err}
+	PrintError(e.Error())
+	return e
+}
+
+// Wait for the requests still in flight, discarding their results
+func (d *downloader) drain(results chan fetchResult, inFlight int) {
+	for ; inFlight > 0; inFlight-- {
+		<-results
+	}
+}
@@ -0,0 +1,63 @@
+package moduls
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A download keeps several requests in flight, never more than the window, and writes every file whole
+func TestDownloadWindow(t *testing.T) {
+	defer func(window int) { DownloadWindow = window }(DownloadWindow)
+	DownloadWindow = 4
+
+	store := datumStore{}
+	big, small := testContent(40*CHUNK_SIZE+10), testContent(100)
+	root := store.dir(testEntry{"big", store.file(big)}, testEntry{"small", store.file(small)})
+
+	// the peer answers each request 20ms after it came, counting those it holds (retransmissions are ignored)
+	peer, conn := loopbackPair(t)
+	var mutex sync.Mutex
+	seen, held := map[uint32]bool{}, map[uint32]bool{}
+	maxHeld := 0
+	answerWith(peer, func(m *Message) *Message {
+		mutex.Lock()
+		if seen[m.Id] {
+			mutex.Unlock()
+			return nil
+		}
+		seen[m.Id], held[m.Id] = true, true
+		maxHeld = max(maxHeld, len(held))
+		mutex.Unlock()
+		go func(from *net.UDPAddr) {
+			time.Sleep(20 * time.Millisecond)
+			mutex.Lock()
+			delete(held, m.Id)
+			mutex.Unlock()
+			writeMessage(peer, from, store.reply(m))
+		}(conn.LocalAddr().(*net.UDPAddr))
+		return nil
+	})
+	defer CloseTransactions(conn)
+
+	out := t.TempDir()
+	obj := DataObject{Op: OP_DOWNLOAD_HASH, Type: NODE_UNKNOWN, HddPath: out}
+	if DownloadData(conn, root, "me", &obj) != RESULT_OK {
+		t.Fatal("download failed")
+	}
+	for name, want := range map[string][]byte{"big": big, "small": small} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: %d bytes written, want %d (%v)", name, len(got), len(want), err)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if maxHeld < 2 || maxHeld > DownloadWindow {
+		t.Errorf("%d requests in flight at most, want 2 to %d", maxHeld, DownloadWindow)
+	}
+}
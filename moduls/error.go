@@ -1,11 +1,8 @@
 package moduls
 
 import (
-	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 )
 
 const (
@@ -53,20 +50,69 @@ func DebugPrint(msg interface{}) {
 	}
 }
 
-func CheckTypeEquality(wantedType byte, recieved []byte) int {
-	if recieved[POS_TYPE:POS_LENGTH][0] != wantedType {
-		len := binary.BigEndian.Uint16(recieved[POS_LENGTH:POS_HASH])
-		log.Printf("%s Not a %d was recieved, but %d. Message: %s %s\n\n",
-			string(colorYellow),
-			wantedType,
-			recieved[POS_TYPE:POS_LENGTH][0],
-			hex.EncodeToString(recieved[POS_HASH:(POS_HASH+len)]),
-			string(colorReset))
-		return -1
+// Errors of request/reply exchanges
+var (
+	ErrTimeout = errors.New("no reply before deadline")
+	ErrClosed  = errors.New("transaction table closed")
+)
+
+var ErrNoDatum = errors.New("NO_DATUM was received")
+
+// A shared file no longer matches the hashes of the tree being served
+var ErrFileChanged = errors.New("file changed since it was hashed")
+
+// The server gave a peer another key than the one pinned for it (see PinPeerKey)
+var ErrKeyChanged = errors.New("key differs from the one pinned in known_peers")
+
+func NoDatumRecieved() error {
+	return ErrNoDatum
+}
+
+// Kinds of malformed datagrams, wrapped in MessageError
+var (
+	ErrShortMessage   = errors.New("datagram shorter than header")
+	ErrLengthMismatch = errors.New("length field does not match datagram size")
+	ErrBadBody        = errors.New("body does not have the shape required by its type")
+	ErrBadSignature   = errors.New("signature has wrong size")
+	ErrTooLong        = errors.New("message does not fit in a datagram")
+	ErrUnexpectedType = errors.New("unexpected type of message")
+	ErrUnsigned       = errors.New("message must be signed")
+	ErrUnknownKey     = errors.New("key of sender unknown, signature can't be checked")
+	ErrWrongSignature = errors.New("signature does not match the key of the sender")
+	ErrNoSession      = errors.New("sealed message from a node without encrypted session")
+	ErrUnsealed       = errors.New("sealed message can't be decrypted with the key of the session")
+)
+
+// Error of encoding or decoding of a message
+type MessageError struct {
+	Type   byte   // type of message, NO_OP if the header could not be read
+	Err    error  // one of Err* above
+	Detail string // what exactly was wrong, may be empty
+}
+
+func (e *MessageError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("%s: %v", TypeName(e.Type), e.Err)
 	}
-	return 0
+	return fmt.Sprintf("%s: %v (%s)", TypeName(e.Type), e.Err, e.Detail)
 }
 
-func NoDatumRecieved() error {
-	return errors.New("NO_DATUM was received")
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// Node received from a peer that does not follow the structure of the tree
+type StructureError struct {
+	Peer string // peer that sent the node
+	Path string // place of the node in the tree of the peer
+	Hash []byte
+	Err  error
+}
+
+func (e *StructureError) Error() string {
+	return fmt.Sprintf("bad node %x at %s sent by peer %s: %v", e.Hash, e.Path, e.Peer, e.Err)
+}
+
+func (e *StructureError) Unwrap() error {
+	return e.Err
 }
@@ -0,0 +1,229 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Where the state of each share is kept between runs (can be set by "state=" in config, "state=none" disables it)
+var StateDir = defaultStateDir()
+
+// Hash every file again instead of trusting the hash cache (set by --rehash)
+var ForceRehash = false
+
+// Name of the hash cache in the state directory of a share
+const HASH_CACHE_FILE = "hashes.gob"
+
+// A file modified less than this before it was hashed may have been modified again within the same mtime,
+// so its hashes are not reused
+const HASH_CACHE_RACY = 2 * time.Second
+
+func defaultStateDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "betweenus", "shares")
+}
+
+// State directory of the share at path, one per shared directory or file.
+// Return: "" if state is disabled
+func ShareStateDir(path string) string {
+	if StateDir == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(StateDir, hex.EncodeToString(sum[:8]))
+}
+
+// Hashes of the files of a share, saved in its state directory so a restart doesn't read every file again.
+// An entry is reused only while the file has the same size, modification time and inode as when it was hashed.
+// It holds the whole subtree of the file, chunks and BIG_FILE nodes, so a file that didn't change isn't hashed at all.
+// Directory nodes are not cached: checking them would take the listing and stat of every entry,
+// which is all building them takes besides one sha256 per MAX_DIR_ENTRIES entries.
+type HashCache struct {
+	path    string // of the cache file, "" if it is not saved
+	mutex   sync.Mutex
+	entries map[string]hashCacheEntry // path of file (as hashDir writes it) -> hashes
+	used    map[string]bool           // entries looked up or stored since the last save
+	changed bool
+
+	hits   int
+	hashed int
+	stale  int // entries that --rehash found wrong
+}
+
+type hashCacheEntry struct {
+	Size   int64
+	Mtime  int64 // ns
+	Inode  uint64
+	Hashed int64  // ns, when hashing started
+	Leaves []byte // hashes of the chunks, in file order
+	Inner  []byte // hashes of the BIG_FILE nodes, in the order buildBTree builds them (none before they were cached)
+	Root   []byte // hash of the file
+}
+
+var hashCachesMutex sync.Mutex
+var hashCaches = map[string]*HashCache{}
+
+// Hash cache of the share at path, loaded from its state directory at first use
+func ShareHashCache(path string) *HashCache {
+	hashCachesMutex.Lock()
+	defer hashCachesMutex.Unlock()
+
+	if c, ok := hashCaches[path]; ok {
+		return c
+	}
+	c := &HashCache{
+		entries: map[string]hashCacheEntry{},
+		used:    map[string]bool{},
+	}
+	if dir := ShareStateDir(path); dir != "" {
+		c.path = filepath.Join(dir, HASH_CACHE_FILE)
+		c.load()
+	}
+	hashCaches[path] = c
+	return c
+}
+
+func (c *HashCache) load() {
+	file, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = gob.NewDecoder(file).Decode(&c.entries)
+		file.Close()
+	}
+	if err != nil {
+		HandlePanicError(err, "Hash cache "+c.path+" ignored")
+		c.entries = map[string]hashCacheEntry{}
+	}
+}
+
+// Hashes of the chunks and of the BIG_FILE nodes of file at path, nil if they are not known for this version of the file
+func (c *HashCache) Get(path string, info os.FileInfo) (leaves [][]byte, inner []byte, root []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[path]
+	if !ok || !e.matches(info) || len(e.Leaves) == 0 || len(e.Leaves)%HASH_SIZE != 0 {
+		return nil, nil, nil
+	}
+	c.used[path] = true
+	c.hits++
+	for i := 0; i < len(e.Leaves); i += HASH_SIZE {
+		leaves = append(leaves, e.Leaves[i:i+HASH_SIZE])
+	}
+	return leaves, e.Inner, e.Root
+}
+
+// Record hashes of file at path, as it was when hashing started (info, at time hashed)
+func (c *HashCache) Put(path string, info os.FileInfo, hashed time.Time, leaves []Node, inner []byte, root []byte) {
+	e := hashCacheEntry{
+		Size:   info.Size(),
+		Mtime:  info.ModTime().UnixNano(),
+		Inode:  fileInode(info),
+		Hashed: hashed.UnixNano(),
+		Inner:  inner,
+		Root:   root,
+	}
+	for _, n := range leaves {
+		e.Leaves = append(e.Leaves, n.Hash...)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.used[path] = true
+	c.hashed++
+	if old, ok := c.entries[path]; ok && old.matches(info) && bytes.Equal(old.Root, root) && bytes.Equal(old.Inner, inner) {
+		return
+	} else if ok && old.matches(info) && !bytes.Equal(old.Root, root) {
+		c.stale++
+	}
+	c.entries[path] = e
+	c.changed = true
+}
+
+// Drop the hashes of file at path, so it is read again at the next rehash
+func forgetHashes(path string) {
+	hashCachesMutex.Lock()
+	defer hashCachesMutex.Unlock()
+	for _, c := range hashCaches {
+		c.mutex.Lock()
+		if _, ok := c.entries[path]; ok {
+			delete(c.entries, path)
+			c.changed = true
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func (e *hashCacheEntry) matches(info os.FileInfo) bool {
+	return e.Size == info.Size() &&
+		e.Mtime == info.ModTime().UnixNano() &&
+		e.Inode == fileInode(info) &&
+		e.Mtime+int64(HASH_CACHE_RACY) <= e.Hashed
+}
+
+// Write cache to the state directory.
+// If prune, entries of files not seen since the last save are dropped (after a build of the whole tree).
+func (c *HashCache) Save(prune bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if prune {
+		for path := range c.entries {
+			if !c.used[path] {
+				delete(c.entries, path)
+				c.changed = true
+			}
+		}
+	}
+	c.used = map[string]bool{}
+	if c.path == "" || !c.changed {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		HandlePanicError(err, "Hash cache: mkdir")
+		return
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", c.path, os.Getpid())
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err == nil {
+		err = gob.NewEncoder(file).Encode(c.entries)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.path)
+	}
+	if err != nil {
+		HandlePanicError(err, "Hash cache: write")
+		os.Remove(tmp)
+		return
+	}
+	c.changed = false
+}
+
+// Use of the cache since the last call: files reused, files hashed, and entries --rehash found wrong
+func (c *HashCache) takeCounts() (hits int, hashed int, stale int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	hits, hashed, stale = c.hits, c.hashed, c.stale
+	c.hits, c.hashed, c.stale = 0, 0, 0
+	return hits, hashed, stale
+}
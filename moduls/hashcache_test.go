@@ -0,0 +1,91 @@
+package moduls
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Hashes are reused across runs while files keep their size, mtime and inode; --rehash reads them all again
+func TestHashCache(t *testing.T) {
+	defer func(dir string) { StateDir = dir }(StateDir)
+	StateDir = t.TempDir()
+
+	files := map[string][]byte{}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("f%02d", i)] = testContent(i * 3000)
+	}
+	share := writeShare(t, files)
+	old := time.Now().Add(-time.Hour)
+	for name := range files {
+		os.Chtimes(filepath.Join(share, name), old, old)
+	}
+
+	built := Merkelify(share)
+	hashCaches = map[string]*HashCache{} // as after a restart
+	if c := ShareHashCache(share); len(c.entries) != len(files) {
+		t.Fatalf("%d files in the saved cache, want %d", len(c.entries), len(files))
+	}
+	if r := Merkelify(share); !bytes.Equal(r.Hash, built.Hash) {
+		t.Fatalf("root %x from the cache, %x hashed", r.Hash, built.Hash)
+	}
+
+	// same size and mtime, other content: the cache can't tell
+	path := filepath.Join(share, "f10")
+	os.WriteFile(path, testContent(30001)[1:], 0644)
+	os.Chtimes(path, old, old)
+	if r := Merkelify(share); !bytes.Equal(r.Hash, built.Hash) {
+		t.Errorf("root %x, want %x from the cache", r.Hash, built.Hash)
+	}
+	ForceRehash = true
+	defer func() { ForceRehash = false }()
+	rehashed := Merkelify(share)
+	if bytes.Equal(rehashed.Hash, built.Hash) {
+		t.Error("--rehash reused the stale hashes")
+	}
+	ForceRehash = false
+	if r := Merkelify(share); !bytes.Equal(r.Hash, rehashed.Hash) {
+		t.Errorf("root %x after --rehash, want %x", r.Hash, rehashed.Hash)
+	}
+
+	// entries of removed files are dropped
+	os.Remove(filepath.Join(share, "f11"))
+	Merkelify(share)
+	hashCaches = map[string]*HashCache{}
+	if c := ShareHashCache(share); len(c.entries) != len(files)-1 {
+		t.Errorf("%d files in the saved cache, want %d", len(c.entries), len(files)-1)
+	}
+}
+
+// A file read back from the hash cache, BIG_FILE nodes included, gives the tree hashing it gave
+func TestCachedFileTree(t *testing.T) {
+	defer func(dir string) { StateDir = dir }(StateDir)
+	StateDir = t.TempDir()
+
+	path := filepath.Join(t.TempDir(), "big")
+	if err := os.WriteFile(path, testContent(33*32*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	hashed, b := build(path)
+	b.cache.Save(true)
+	delete(hashCaches, path) // load it from disk
+	cached, b := build(path)
+	if hits, n, _ := b.cache.takeCounts(); hits != 1 || n != 0 {
+		t.Fatalf("%d files from the cache, %d hashed", hits, n)
+	}
+	if !reflect.DeepEqual(cached, hashed) {
+		t.Errorf("tree from the cache differs, root %x instead of %x", cached.Hash, hashed.Hash)
+	}
+	if inner := b.cache.entries[path].Inner; len(inner) != bigFileCount(33*32)*HASH_SIZE {
+		t.Errorf("%d bytes of BIG_FILE hashes cached for %d nodes", len(inner), bigFileCount(33*32))
+	}
+}
@@ -0,0 +1,206 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tests don't keep state in the user's directories
+func TestMain(m *testing.M) {
+	StateDir, KnownPeersFile = "", ""
+	os.Exit(m.Run())
+}
+
+// Two UDP sockets on loopback: peer, unconnected, and conn, connected to peer.
+// Both are closed at the end of the test.
+func loopbackPair(t *testing.T) (peer *net.UDPConn, conn *net.UDPConn) {
+	t.Helper()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	conn, err = net.DialUDP("udp", nil, peer.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return peer, conn
+}
+
+// Answer each message peer receives with what answer returns for it, nothing if nil, until peer is closed
+func answerWith(peer *net.UDPConn, answer func(m *Message) *Message) {
+	go func() {
+		buf := make([]byte, DATAGRAM_SIZE)
+		for {
+			m, from, err := readMessage(peer, buf)
+			if err != nil {
+				if _, ok := err.(*MessageError); ok {
+					continue
+				}
+				return
+			}
+			if reply := answer(m); reply != nil {
+				writeMessage(peer, from, reply)
+			}
+		}
+	}()
+}
+
+// Content of a test file: not periodic over a chunk, so that a misplaced chunk changes the hash
+func testContent(size int) []byte {
+	data := make([]byte, size)
+	x := uint32(size) | 1
+	for i := range data {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		data[i] = byte(x)
+	}
+	return data
+}
+
+// Datums served by a test peer, by hash
+type datumStore map[string][]byte
+
+// Add value to s
+// Return: its hash
+func (s datumStore) add(value []byte) []byte {
+	hash := sha256.Sum256(value)
+	s[string(hash[:])] = value
+	return hash[:]
+}
+
+// Add the nodes of a file of content data to s: chunks, then BIG_FILE nodes of at most MAX_CHILDREN children
+// Return: hash of the root of the file
+func (s datumStore) file(data []byte) []byte {
+	var level [][]byte
+	for off := 0; off == 0 || off < len(data); off += CHUNK_SIZE {
+		end := off + CHUNK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		level = append(level, s.add(append([]byte{CHUNK}, data[off:end]...)))
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += MAX_CHILDREN {
+			group := level[i:min(i+MAX_CHILDREN, len(level))]
+			if len(group) == 1 {
+				next = append(next, group[0]) // a lone node moves up a level
+				continue
+			}
+			value := []byte{BIG_FILE}
+			for _, hash := range group {
+				value = append(value, hash...)
+			}
+			next = append(next, s.add(value))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Entry of a directory added to a datumStore
+type testEntry struct {
+	name string
+	hash []byte
+}
+
+// Add a directory node of entries to s
+// Return: its hash
+func (s datumStore) dir(entries ...testEntry) []byte {
+	value := []byte{DIRECTORY}
+	for _, e := range entries {
+		name := make([]byte, NAME_SIZE)
+		copy(name, e.name)
+		value = append(append(value, name...), e.hash...)
+	}
+	return s.add(value)
+}
+
+// Datum of s for request m, NoDatum if s doesn't have it
+func (s datumStore) reply(m *Message) *Message {
+	if value, ok := s[string(m.Body)]; ok {
+		return NewDatumMessage(m.Id, m.Body, value)
+	}
+	return NewHashMessage(m.Id, NO_DATUM, m.Body)
+}
+
+// Directory made of files: path relative to it => content, a path ending in "/" being an empty directory
+func writeShare(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for rel, content := range files {
+		path := filepath.Join(dir, rel)
+		if strings.HasSuffix(rel, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Serve tree root like Server mode, on a loopback socket
+// Return: a socket connected to it
+func serveTree(t *testing.T, root Node) *net.UDPConn {
+	t.Helper()
+	ShareTree(&root)
+	peer, conn := loopbackPair(t)
+	ServeIncoming(peer, "peer")
+	t.Cleanup(func() {
+		CloseTransactions(conn)
+		CloseTransactions(peer)
+	})
+	return conn
+}
+
+// Check that directory got holds the same files and directories as want
+func sameFiles(t *testing.T, want string, got string) {
+	t.Helper()
+	seen := map[string]bool{}
+	filepath.WalkDir(got, func(path string, d fs.DirEntry, err error) error {
+		if rel, _ := filepath.Rel(got, path); err == nil {
+			seen[rel] = true
+		}
+		return nil
+	})
+	filepath.WalkDir(want, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(want, path)
+		delete(seen, rel)
+		info, err := os.Stat(filepath.Join(got, rel))
+		switch {
+		case err != nil:
+			t.Errorf("%s: %v", rel, err)
+		case d.IsDir() != info.IsDir():
+			t.Errorf("%s: directory %v, want %v", rel, info.IsDir(), d.IsDir())
+		case !d.IsDir():
+			wantData, _ := os.ReadFile(path)
+			gotData, _ := os.ReadFile(filepath.Join(got, rel))
+			if !bytes.Equal(gotData, wantData) {
+				t.Errorf("%s: %d bytes differ from the %d published", rel, len(gotData), len(wantData))
+			}
+		}
+		return nil
+	})
+	for rel := range seen {
+		t.Errorf("%s: not published", rel)
+	}
+}
@@ -0,0 +1,167 @@
+package moduls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// File of the identity key pair, created at first start (can be set by "key=" in config, "key=none" makes a new key per run)
+var IdentityFile = defaultIdentityFile()
+
+// Type of the PEM block of the identity file
+const IDENTITY_PEM_TYPE = "PRIVATE KEY"
+
+func defaultIdentityFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "betweenus", "identity.pem")
+}
+
+// P-256 key pair that identifies this node to the server and to peers.
+// Kept in a file so that peers recognise us across restarts.
+// The private key is only reached through signer: it may live in another process (see DialAgent).
+type Identity struct {
+	signer crypto.Signer
+	public []byte // as sent in PublicKey messages, so that the signer is not asked for it each time
+	path   string // file or agent socket the key is kept in, "" if it only lives in memory
+}
+
+// Identity used by the protocol functions, nil until UseIdentity is called
+var identity atomic.Pointer[Identity]
+
+// Make id the identity of this node
+func UseIdentity(id *Identity) {
+	identity.Store(id)
+}
+
+// Identity of this node, nil if none was set
+func MyIdentity() *Identity {
+	return identity.Load()
+}
+
+// New identity, not saved: peers see a different node at each run
+func NewIdentity() (*Identity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return SignerIdentity(key, "")
+}
+
+// Identity whose key is held by signer (an *ecdsa.PrivateKey, or an AgentSigner), kept at path
+// Return: error if the key of signer is not a P-256 ECDSA key
+func SignerIdentity(signer crypto.Signer, path string) (*Identity, error) {
+	public, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok || public.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("identity %s: not a P-256 ECDSA key", path)
+	}
+	return &Identity{signer: signer, public: FormatPublicKey(public), path: path}, nil
+}
+
+// Identity kept in file at path (see LoadKeyFile).
+// The file is created if it doesn't exist.
+func LoadIdentity(path string) (*Identity, error) {
+	key, err := LoadKeyFile(path)
+	if os.IsNotExist(err) {
+		return createIdentity(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return SignerIdentity(key, path)
+}
+
+// Key kept in file at path, in PEM encoded PKCS#8.
+// It must not be readable by other users, as with ssh keys.
+// Return: error if it can't be read, or is not a P-256 key
+func LoadKeyFile(path string) (*ecdsa.PrivateKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// the file opened is the one checked, and it is checked before anything is read from it
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyPermissions(info); err != nil {
+		return nil, fmt.Errorf("identity %s: %w", path, err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != IDENTITY_PEM_TYPE {
+		return nil, fmt.Errorf("identity %s: no %q PEM block", path, IDENTITY_PEM_TYPE)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("identity %s: %w", path, err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("identity %s: not a P-256 ECDSA key", path)
+	}
+	return key, nil
+}
+
+// Generate an identity and write it to a new file at path, readable by us only
+func createIdentity(path string) (*Identity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// O_EXCL: never overwrite a key another process just created
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = pem.Encode(file, &pem.Block{Type: IDENTITY_PEM_TYPE, Bytes: der})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	fmt.Printf("New identity key written to %s\n", path)
+	return SignerIdentity(key, path)
+}
+
+// Public key as sent in PublicKey messages: X and Y, 32 bytes each
+func (id *Identity) PublicKey() []byte {
+	return id.public
+}
+
+// Signature of data by the identity, 64 bytes (see SignMessage)
+// Return: error if the signer failed, e.g. its agent can't be reached
+func (id *Identity) Sign(data []byte) ([]byte, error) {
+	return SignMessage(data, id.signer)
+}
+
+// File or agent socket the identity is kept in, "" if it is not saved
+func (id *Identity) Path() string {
+	return id.path
+}
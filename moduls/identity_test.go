@@ -0,0 +1,88 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The identity is created once, readable by its owner only, and the same key is loaded at each start
+func TestLoadIdentityCreatesOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf", "identity.pem")
+	created, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file created with mode %04o, want 0600", perm)
+	}
+	loaded, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.PublicKey(), created.PublicKey()) || loaded.Path() != path {
+		t.Errorf("loaded key %x from %q, created %x in %q", loaded.PublicKey(), loaded.Path(), created.PublicKey(), path)
+	}
+}
+
+// Key files that are readable by others or that don't hold a P-256 key are refused
+func TestLoadIdentityRefuses(t *testing.T) {
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(p384)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	goodDer, _ := x509.MarshalPKCS8PrivateKey(p256)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		perm    os.FileMode
+		problem string // in the error
+	}{
+		{"readable by others", pem.EncodeToMemory(&pem.Block{Type: IDENTITY_PEM_TYPE, Bytes: goodDer}), 0644, "too open"},
+		{"readable by others, checked before it is parsed", []byte("key"), 0644, "too open"},
+		{"not PEM", []byte("key"), 0600, "PEM block"},
+		{"other PEM block", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: goodDer}), 0600, "PEM block"},
+		{"not PKCS#8", pem.EncodeToMemory(&pem.Block{Type: IDENTITY_PEM_TYPE, Bytes: []byte{1, 2}}), 0600, "asn1"},
+		{"P-384 key", pem.EncodeToMemory(&pem.Block{Type: IDENTITY_PEM_TYPE, Bytes: der}), 0600, "P-256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "identity.pem")
+			if err := os.WriteFile(path, tt.data, tt.perm); err != nil {
+				t.Fatal(err)
+			}
+			os.Chmod(path, tt.perm) // whatever the umask
+			if _, err := LoadIdentity(path); err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Errorf("LoadIdentity = %v, want an error about %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+// A peer asking for our key gets the one of our identity
+func TestPublicKeyReply(t *testing.T) {
+	defer UseIdentity(MyIdentity())
+	id, _ := NewIdentity()
+	UseIdentity(id)
+
+	conn := serveTree(t, Merkelify(writeShare(t, map[string][]byte{"f": nil})))
+	reply, err := exchange(conn, nil, NewPublicKeyMessage(0, PUBLIC_KEY, nil), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != PUBLIC_KEY_REPLY || !bytes.Equal(reply.Body, id.PublicKey()) {
+		t.Errorf("reply of type %d with key %x, want %x", reply.Type, reply.Body, id.PublicKey())
+	}
+}
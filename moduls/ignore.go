@@ -0,0 +1,163 @@
+package moduls
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Ignore file read in the root of a share and in each of its directories, in gitignore syntax
+const IGNORE_FILE = ".betweenusignore"
+
+// Patterns excluded from every share, applied before the ignore files (set by "exclude=" lines in config)
+var ExcludePatterns []string
+
+// Rules deciding what is left out of a share: the config patterns, then the ignore files from the root down.
+// As in gitignore the last rule that matches decides, so deeper files override shallower ones,
+// and nothing below an ignored directory is looked at.
+type ignoreRules struct {
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	base    string // directory of the ignore file, relative to the share root ("" for the root)
+	pattern *regexp.Regexp
+	negate  bool // "!pattern": publish again what an earlier rule ignored
+	dirOnly bool // "pattern/": matches directories only
+}
+
+// Rules of the root of a share: the config patterns
+func rootIgnoreRules() *ignoreRules {
+	r := &ignoreRules{}
+	for _, line := range ExcludePatterns {
+		if rule, ok := parseIgnoreLine(line, ""); ok {
+			r.rules = append(r.rules, rule)
+		}
+	}
+	return r
+}
+
+// Rules for the entries of directory dir (relative to the share root, "" for the root):
+// the rules of its parent followed by those of its own ignore file, if any
+func (r *ignoreRules) forDir(path string, dir string) *ignoreRules {
+	file, err := os.Open(path + "/" + IGNORE_FILE)
+	if err != nil {
+		return r
+	}
+	defer file.Close()
+
+	child := &ignoreRules{rules: append([]ignoreRule(nil), r.rules...)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreLine(scanner.Text(), dir); ok {
+			child.rules = append(child.rules, rule)
+		}
+	}
+	HandlePanicError(scanner.Err(), "reading "+path+"/"+IGNORE_FILE)
+	return child
+}
+
+// Is entry at rel (relative to the share root) ignored
+func (r *ignoreRules) Ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range r.rules {
+		sub := rel
+		if rule.base != "" {
+			if !strings.HasPrefix(rel, rule.base+"/") {
+				continue
+			}
+			sub = rel[len(rule.base)+1:]
+		}
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.pattern.MatchString(sub) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// Parse one line of an ignore file found in directory base
+func parseIgnoreLine(line string, base string) (ignoreRule, bool) {
+	rule := ignoreRule{base: base}
+
+	// trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+
+	// a pattern with a slash other than at the end is relative to the directory of the ignore file,
+	// otherwise it matches a name at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if !anchored && !strings.HasPrefix(line, "**") {
+		expr = "(?:.*/)?" + expr
+	}
+	pattern, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		PanicMessage(fmt.Sprintf("ignore pattern %q skipped: %v", line, err))
+		return rule, false
+	}
+	rule.pattern = pattern
+	return rule, true
+}
+
+// Translate a gitignore glob to a regular expression:
+// "*" and "?" don't match '/', "[...]" is a class, "**/" "/**/" and "/**" match any number of directories
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**") && i+2 == len(glob):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			i += end + 1
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
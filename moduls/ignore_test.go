@@ -0,0 +1,102 @@
+package moduls
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Rules of the root of a share made of lines of an ignore file
+func rulesOf(lines ...string) *ignoreRules {
+	r := &ignoreRules{}
+	for _, line := range lines {
+		if rule, ok := parseIgnoreLine(line, ""); ok {
+			r.rules = append(r.rules, rule)
+		}
+	}
+	return r
+}
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		rel     string
+		isDir   bool
+		ignored bool
+	}{
+		{"no rule", nil, "a.txt", false, false},
+		{"name at the root", []string{"*.o"}, "main.o", false, true},
+		{"name at any depth", []string{"*.o"}, "src/lib/main.o", false, true},
+		{"star stops at slash", []string{"src/*.o"}, "src/lib/main.o", false, false},
+		{"anchored by a slash", []string{"/build"}, "build", true, true},
+		{"anchored not deeper", []string{"/build"}, "src/build", true, false},
+		{"slash inside anchors", []string{"doc/tmp"}, "x/doc/tmp", false, false},
+		{"question mark", []string{"?.log"}, "a.log", false, true},
+		{"question mark is one character", []string{"?.log"}, "ab.log", false, false},
+		{"class", []string{"[ab].c"}, "b.c", false, true},
+		{"negated class", []string{"[!ab].c"}, "b.c", false, false},
+		{"negated class matches others", []string{"[!ab].c"}, "z.c", false, true},
+		{"unclosed bracket is literal", []string{"[ab"}, "[ab", false, true},
+		{"leading double star", []string{"**/cache"}, "a/b/cache", true, true},
+		{"double star at the root", []string{"**/cache"}, "cache", true, true},
+		{"inner double star", []string{"a/**/z"}, "a/b/c/z", false, true},
+		{"inner double star matches none", []string{"a/**/z"}, "a/z", false, true},
+		{"trailing double star", []string{"logs/**"}, "logs/2024/x", false, true},
+		{"directory only matches directory", []string{"tmp/"}, "tmp", true, true},
+		{"directory only skips files", []string{"tmp/"}, "tmp", false, false},
+		{"negation publishes again", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"last rule wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"comment", []string{"# a.txt"}, "# a.txt", false, false},
+		{"escaped hash", []string{`\#a.txt`}, "#a.txt", false, true},
+		{"escaped bang", []string{`\!a.txt`}, "!a.txt", false, true},
+		{"trailing spaces dropped", []string{"a.txt   "}, "a.txt", false, true},
+		{"escaped trailing space kept", []string{`a\ `}, "a ", false, true},
+		{"dot is literal", []string{"a.c"}, "abc", false, false},
+		{"regexp characters are literal", []string{"a+(b)"}, "a+(b)", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rulesOf(tt.lines...).Ignored(tt.rel, tt.isDir); got != tt.ignored {
+				t.Errorf("%q ignores %q: %v, want %v", tt.lines, tt.rel, got, tt.ignored)
+			}
+		})
+	}
+}
+
+// An ignore file applies below its directory only, after the rules above it
+func TestIgnoreFilesNest(t *testing.T) {
+	share := t.TempDir()
+	sub := filepath.Join(share, "sub")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(dir string, content string) {
+		if err := os.WriteFile(filepath.Join(dir, IGNORE_FILE), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(share, "*.log\n")
+	write(sub, "!keep.log\n/local\n")
+
+	root := rulesOf().forDir(share, "")
+	inSub := root.forDir(sub, "sub")
+	tests := []struct {
+		rules   *ignoreRules
+		rel     string
+		ignored bool
+	}{
+		{root, "a.log", true},
+		{root, "keep.log", true},
+		{root, "local", false},
+		{inSub, "sub/a.log", true},
+		{inSub, "sub/keep.log", false},
+		{inSub, "sub/local", true},
+		{inSub, "sub/x/local", false},
+	}
+	for _, tt := range tests {
+		if got := tt.rules.Ignored(tt.rel, false); got != tt.ignored {
+			t.Errorf("%q ignored %v, want %v", tt.rel, got, tt.ignored)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Keep a copy of every chunk published, so files edited after they were hashed are still served
+// as they were published until the new tree replaces the old one (set by "snapshot=on" in config)
+var SnapshotMode = false
+
+// Size cap of the snapshot store in bytes (can be set in MB by "snapshot_size=" in config).
+// Chunks evicted to fit are read from their file again, and served only if it didn't change.
+var SnapshotMaxSize int64 = 4 << 30
+
+// Private content store of the published chunks in snapshot mode, nil otherwise.
+// It only keeps the chunks of the tree served: the others are dropped when a new tree replaces it.
+var Snapshots *DatumCache
+
+// Open the content store of snapshot mode, in the state directory
+func OpenSnapshots() (*DatumCache, error) {
+	if StateDir == "" {
+		return nil, fmt.Errorf("snapshot mode needs a state directory")
+	}
+	return OpenDatumCache(filepath.Join(StateDir, "snapshot"), SnapshotMaxSize)
+}
+
+// Index of the tree we share: hash -> what to send in the Datum.
+// It is built once per tree and never modified, a new tree gets a new index swapped in atomically,
+// so requests being served while the share is rehashed see either the old tree or the new one.
+type NodeIndex struct {
+	nodes map[string]indexEntry // key is the hash as a string
+}
+
+// What is needed to send a node
+type indexEntry struct {
+	value  []byte       // serialized value of BIG_FILE and DIRECTORY nodes, nil for CHUNK
+	places []chunkPlace // every file that holds a CHUNK, in the order of the tree
+}
+
+// Where a CHUNK is found on disk
+type chunkPlace struct {
+	path   string // file of the chunk
+	offset int64  // position of the chunk in its file
+}
+
+// Index of the tree currently shared, nil while nothing is
+var sharedIndex atomic.Pointer[NodeIndex]
+
+// Build the index of tree
+func NewNodeIndex(root *Node) *NodeIndex {
+	idx := &NodeIndex{
+		nodes: map[string]indexEntry{},
+	}
+	idx.add(root)
+	return idx
+}
+
+// Same content elsewhere in the tree is indexed once, but its children are walked again:
+// a chunk is served from any of the files that hold it
+func (idx *NodeIndex) add(n *Node) {
+	entry, seen := idx.nodes[string(n.Hash)]
+	switch {
+	case n.NodeType == CHUNK:
+		entry.places = append(entry.places, chunkPlace{n.Path, n.Offset})
+	case seen:
+	case n.NodeType == BIG_FILE:
+		entry.value = bigFileValue(n.Children)
+	case n.NodeType == DIRECTORY:
+		entry.value = directoryValue(n.Children)
+	}
+	idx.nodes[string(n.Hash)] = entry
+	for i := range n.Children {
+		idx.add(&n.Children[i])
+	}
+}
+
+// Value of the datum with hash.
+// Chunks are taken from the snapshot store, or read from disk and checked against their hash:
+// a file that changed is rehashed (see fileChanged) and the next file holding the chunk is tried,
+// ErrFileChanged is returned if none still does.
+// Return: nil if the hash is not in the tree
+func (idx *NodeIndex) Lookup(hash []byte) ([]byte, error) {
+	entry, ok := idx.nodes[string(hash)]
+	if !ok {
+		return nil, nil
+	}
+	if entry.value != nil {
+		return entry.value, nil
+	}
+	if Snapshots != nil {
+		if value := Snapshots.Get(hash); value != nil {
+			return value, nil
+		}
+	}
+
+	var err error
+	for _, place := range entry.places {
+		var data []byte
+		data, err = readChunk(place.path, place.offset)
+		if err != nil {
+			fileChanged(place.path) // removed or replaced
+			continue
+		}
+		value := append([]byte{CHUNK}, data...)
+		if sum := sha256.Sum256(value); !bytes.Equal(sum[:], hash) {
+			fileChanged(place.path)
+			err = fmt.Errorf("%s: %w", place.path, ErrFileChanged)
+			continue
+		}
+		if Snapshots != nil {
+			Snapshots.Put(hash, value)
+		}
+		return value, nil
+	}
+	return nil, err
+}
+
+// Is the node with hash in the indexed tree
+func (idx *NodeIndex) Has(hash []byte) bool {
+	_, ok := idx.nodes[string(hash)]
+	return ok
+}
+
+// Start serving tree: its index replaces the previous one, whose chunks are dropped from the snapshot store
+func ShareTree(root *Node) {
+	idx := NewNodeIndex(root)
+	sharedIndex.Store(idx)
+	if Snapshots != nil {
+		Snapshots.Retain(idx.Has)
+	}
+}
+
+// Index of the tree being served, nil if none
+func SharedIndex() *NodeIndex {
+	return sharedIndex.Load()
+}
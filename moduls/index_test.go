@@ -0,0 +1,170 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Every node of the tree is found by its hash, with the value a peer can check against it
+func TestNodeIndexLookup(t *testing.T) {
+	same := testContent(3 * CHUNK_SIZE)
+	share := writeShare(t, map[string][]byte{
+		"a":         same,
+		"sub/copy":  same, // indexed once
+		"sub/big":   testContent(40 * CHUNK_SIZE),
+		"sub/empty": nil,
+		"dir/":      nil,
+	})
+	root := Merkelify(share)
+	idx := NewNodeIndex(&root)
+
+	distinct := map[string]bool{}
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		distinct[string(n.Hash)] = true
+		value, err := idx.Lookup(n.Hash)
+		if err != nil || value == nil {
+			t.Fatalf("%s %x not found: %v", n.Path, n.Hash, err)
+		}
+		if sum := sha256.Sum256(value); !bytes.Equal(sum[:], n.Hash) {
+			t.Errorf("%s: value of %x does not hash to it", n.Path, n.Hash)
+		}
+		if int64(value[0]) != n.NodeType {
+			t.Errorf("%s: value of type %d, node of type %d", n.Path, value[0], n.NodeType)
+		}
+		for i := range n.Children {
+			walk(&n.Children[i])
+		}
+	}
+	walk(&root)
+	if len(idx.nodes) != len(distinct) {
+		t.Errorf("%d nodes indexed, %d in the tree", len(idx.nodes), len(distinct))
+	}
+	if value, err := idx.Lookup(make([]byte, HASH_SIZE)); value != nil || err != nil {
+		t.Errorf("unknown hash found: %v", err)
+	}
+}
+
+// A chunk of a file edited after it was hashed is served as published in snapshot mode,
+// otherwise it is refused and the file rehashed
+func TestLookupFileChanged(t *testing.T) {
+	defer func(dir string, snapshots *DatumCache) { StateDir, Snapshots = dir, snapshots }(StateDir, Snapshots)
+
+	for _, snapshot := range []bool{false, true} {
+		t.Run(map[bool]string{false: "from the file", true: "from the snapshot"}[snapshot], func(t *testing.T) {
+			StateDir, Snapshots = t.TempDir(), nil
+			if snapshot {
+				var err error
+				if Snapshots, err = OpenSnapshots(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			published := testContent(3 * CHUNK_SIZE)
+			share := writeShare(t, map[string][]byte{"f": published})
+			root := Merkelify(share)
+			idx := NewNodeIndex(&root)
+
+			// same size, same mtime: only the hash tells
+			path := filepath.Join(share, "f")
+			info, _ := os.Stat(path)
+			os.WriteFile(path, bytes.Repeat([]byte{1}, len(published)), 0644)
+			os.Chtimes(path, info.ModTime(), info.ModTime())
+			w := WatchShare(root)
+			defer w.Close()
+
+			chunk := root.Children[0].Children[0]
+			value, err := idx.Lookup(chunk.Hash)
+			if snapshot {
+				if err != nil || !bytes.Equal(value, append([]byte{CHUNK}, published[:CHUNK_SIZE]...)) {
+					t.Fatalf("Lookup = %d bytes, %v, want the published chunk", len(value), err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrFileChanged) {
+				t.Fatalf("Lookup = %d bytes, %v, want %v", len(value), err, ErrFileChanged)
+			}
+			select {
+			case r := <-w.Changed():
+				if want := Merkelify(share); !bytes.Equal(r.Hash, want.Hash) {
+					t.Errorf("rehashed root %x, want %x", r.Hash, want.Hash)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("file not rehashed")
+			}
+		})
+	}
+}
+
+// A file whose hashes come from the hash cache has its chunks in the snapshot store too
+func TestSnapshotFromHashCache(t *testing.T) {
+	defer func(dir string, snapshots *DatumCache) { StateDir, Snapshots = dir, snapshots }(StateDir, Snapshots)
+	StateDir, Snapshots = t.TempDir(), nil
+
+	published := testContent(3 * CHUNK_SIZE)
+	share := writeShare(t, map[string][]byte{"f": published})
+	path := filepath.Join(share, "f")
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	Merkelify(share) // hashed before the snapshot mode was on
+
+	var err error
+	if Snapshots, err = OpenSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	root, b := build(share)
+	if hits, n, _ := b.cache.takeCounts(); hits != 1 || n != 0 {
+		t.Fatalf("%d files from the cache, %d hashed", hits, n)
+	}
+	idx := NewNodeIndex(&root)
+
+	// same size, same mtime: only the hash tells
+	os.WriteFile(path, bytes.Repeat([]byte{1}, len(published)), 0644)
+	os.Chtimes(path, old, old)
+
+	for i, chunk := range root.Children[0].Children {
+		value, err := idx.Lookup(chunk.Hash)
+		want := append([]byte{CHUNK}, published[i*CHUNK_SIZE:(i+1)*CHUNK_SIZE]...)
+		if err != nil || !bytes.Equal(value, want) {
+			t.Errorf("chunk %d: Lookup = %d bytes, %v, want the published chunk", i, len(value), err)
+		}
+	}
+}
+
+// A chunk held by several files is served from another one when the first changed
+func TestLookupOtherCopy(t *testing.T) {
+	published := testContent(2 * CHUNK_SIZE)
+	tests := []struct {
+		name   string
+		edited []string
+		err    error
+	}{
+		{"first copy edited", []string{"a"}, nil},
+		{"both copies edited", []string{"a", "sub/b"}, ErrFileChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			share := writeShare(t, map[string][]byte{"a": published, "sub/b": published})
+			root := Merkelify(share)
+			idx := NewNodeIndex(&root)
+			for _, rel := range tt.edited {
+				os.WriteFile(filepath.Join(share, filepath.FromSlash(rel)), bytes.Repeat([]byte{1}, len(published)), 0644)
+			}
+
+			chunk := root.Children[0].Children[1]
+			value, err := idx.Lookup(chunk.Hash)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Lookup = %d bytes, %v, want %v", len(value), err, tt.err)
+			}
+			if err == nil && !bytes.Equal(value, append([]byte{CHUNK}, published[CHUNK_SIZE:]...)) {
+				t.Errorf("Lookup = %d bytes, not the published chunk", len(value))
+			}
+		})
+	}
+}
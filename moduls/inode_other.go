@@ -0,0 +1,12 @@
+//go:build !unix
+
+package moduls
+
+import (
+	"os"
+)
+
+// No inode on this system: files are told apart by size and mtime only
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package moduls
+
+import (
+	"os"
+	"syscall"
+)
+
+// Inode of file, so that a file replaced by another one of the same size and mtime is hashed again
+func fileInode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
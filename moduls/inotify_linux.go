@@ -0,0 +1,117 @@
+//go:build linux
+
+package moduls
+
+import (
+	"os"
+	gopath "path"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// What the watcher asks inotify to report
+const INOTIFY_MASK = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// inotify instance watching every directory of a share
+type inotify struct {
+	fd      int
+	file    *os.File // non blocking, so that close interrupts read
+	mutex   sync.Mutex
+	watches map[int32]string // watch descriptor -> path
+
+	buf     []byte
+	pending []byte // events read but not returned yet
+}
+
+func newInotify() (*inotify, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	return &inotify{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: map[int32]string{},
+		buf:     make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)),
+	}, nil
+}
+
+// Watch path (rel relative to its share) and, if it is a directory, every directory below it
+// that the ignore rules don't leave out. parent: rules for the entries of the directory of path.
+func (n *inotify) addTree(path string, rel string, parent *ignoreRules) error {
+	wd, err := syscall.InotifyAddWatch(n.fd, path, INOTIFY_MASK)
+	if err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	n.watches[int32(wd)] = path
+	n.mutex.Unlock()
+
+	dir, err := os.ReadDir(path)
+	if err != nil {
+		return nil // a file
+	}
+	rules := parent.forDir(path, rel)
+	for _, de := range dir {
+		childRel := gopath.Join(rel, de.Name())
+		if de.IsDir() && !rules.Ignored(childRel, true) {
+			if err := n.addTree(path+"/"+de.Name(), childRel, rules); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Wait for the next event.
+// Return: path concerned ("" if events were lost), is it a directory, was it created (or moved in)
+func (n *inotify) read() (path string, isDir bool, created bool, err error) {
+	for {
+		for len(n.pending) >= syscall.SizeofInotifyEvent {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&n.pending[0]))
+			end := syscall.SizeofInotifyEvent + int(event.Len)
+			name := n.pending[syscall.SizeofInotifyEvent:end]
+			n.pending = n.pending[end:]
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				return "", false, false, nil
+			}
+
+			n.mutex.Lock()
+			dir, ok := n.watches[event.Wd]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.watches, event.Wd)
+			}
+			n.mutex.Unlock()
+			if !ok || event.Mask&syscall.IN_IGNORED != 0 {
+				continue
+			}
+
+			path = dir
+			for i, c := range name {
+				if c == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			if len(name) > 0 {
+				path = dir + "/" + string(name)
+			}
+			isDir = event.Mask&syscall.IN_ISDIR != 0
+			created = event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0
+			return path, isDir, created, nil
+		}
+
+		l, err := n.file.Read(n.buf)
+		if err != nil {
+			return "", false, false, err
+		}
+		n.pending = n.buf[:l]
+	}
+}
+
+func (n *inotify) close() {
+	n.file.Close()
+}
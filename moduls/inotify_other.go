@@ -0,0 +1,24 @@
+//go:build !linux
+
+package moduls
+
+import (
+	"errors"
+)
+
+// inotify exists only on Linux, elsewhere the watcher scans the share
+type inotify struct{}
+
+func newInotify() (*inotify, error) {
+	return nil, errors.New("not available on this system")
+}
+
+func (n *inotify) addTree(path string, rel string, parent *ignoreRules) error {
+	return nil
+}
+
+func (n *inotify) read() (path string, isDir bool, created bool, err error) {
+	return "", false, false, errors.New("not available on this system")
+}
+
+func (n *inotify) close() {}
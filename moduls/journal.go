@@ -0,0 +1,221 @@
+package moduls
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The journal of a download is written next to the download directory: <DownloadDir>.betweenus-journal
+const JOURNAL_SUFFIX = ".betweenus-journal"
+
+// Journal of a download, so that running the same command again continues where it stopped.
+// It is a text file, one record per line:
+//
+//	root <hash> <op> <search path>        what is being downloaded (first line)
+//	node <hash> <value>                   directory or big file node fetched and verified
+//	chunk <hash> <offset> <length> <path> chunk written to file <path> (relative to download directory)
+//
+// Nothing in it is trusted blindly: on resume node values are hashed again,
+// and chunks are read back from the partial files and hashed again before being used.
+type Journal struct {
+	path    string
+	baseDir string
+	mutex   sync.Mutex
+	file    *os.File
+	nodes   map[string][]byte     // hash -> value
+	chunks  map[string][]chunkRef // hash -> places where this chunk was written
+	files   map[string]bool       // files with chunks written, relative to baseDir
+}
+
+type chunkRef struct {
+	path   string // relative to baseDir
+	offset int64
+	length int
+}
+
+// Path of the journal of a download into dir
+func JournalPath(dir string) string {
+	return filepath.Clean(dir) + JOURNAL_SUFFIX
+}
+
+// Open journal of the download of root into baseDir.
+// If the journal was left by an interrupted download of the same root, its records are loaded,
+// otherwise a new journal is started.
+// Return: journal and true if a previous download is resumed
+func OpenJournal(baseDir string, root []byte, op int, searchPath string) (*Journal, bool, error) {
+	j := &Journal{
+		path:    JournalPath(baseDir),
+		baseDir: baseDir,
+		nodes:   map[string][]byte{},
+		chunks:  map[string][]chunkRef{},
+		files:   map[string]bool{},
+	}
+	header := fmt.Sprintf("root %s %d %s", hex.EncodeToString(root), op, searchPath)
+
+	resumed := j.load(header)
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !resumed {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(j.path, flags, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	j.file = file
+
+	if !resumed {
+		if _, err := fmt.Fprintln(file, header); err != nil {
+			file.Close()
+			return nil, false, err
+		}
+	}
+	return j, resumed, nil
+}
+
+// Read records of an existing journal, if it has the same header.
+// Records that don't parse or don't verify are skipped.
+func (j *Journal) load(header string) bool {
+	file, err := os.Open(j.path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 4*DATAGRAM_SIZE), 4*DATAGRAM_SIZE)
+	if !scanner.Scan() || scanner.Text() != header {
+		fmt.Printf("Journal %s is for another download, starting over\n", j.path)
+		return false
+	}
+
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 5)
+		switch {
+		case len(fields) == 3 && fields[0] == "node":
+			hash, err1 := hex.DecodeString(fields[1])
+			value, err2 := hex.DecodeString(fields[2])
+			if err1 != nil || err2 != nil || len(value) == 0 {
+				continue
+			}
+			if sum := sha256.Sum256(value); !bytes.Equal(sum[:], hash) {
+				continue
+			}
+			j.nodes[string(hash)] = value
+
+		case len(fields) == 5 && fields[0] == "chunk":
+			hash, err1 := hex.DecodeString(fields[1])
+			offset, err2 := strconv.ParseInt(fields[2], 10, 64)
+			length, err3 := strconv.Atoi(fields[3])
+			if err1 != nil || err2 != nil || err3 != nil {
+				continue
+			}
+			// a record that doesn't come from AddChunk could make Lookup read anywhere, or allocate a negative size
+			path := filepath.Clean(fields[4])
+			if length < 0 || length > CHUNK_SIZE || offset < 0 || !filepath.IsLocal(path) {
+				continue
+			}
+			j.chunks[string(hash)] = append(j.chunks[string(hash)], chunkRef{path, offset, length})
+			j.files[path] = true
+		}
+	}
+	return true
+}
+
+// Value of node with hash, read from the journal or from a partial file, and verified again.
+// Return: nil if the journal doesn't have it
+func (j *Journal) Lookup(hash []byte) []byte {
+	j.mutex.Lock()
+	value, ok := j.nodes[string(hash)]
+	refs := j.chunks[string(hash)]
+	j.mutex.Unlock()
+
+	if ok {
+		return value
+	}
+
+	for _, ref := range refs {
+		file, err := os.Open(filepath.Join(j.baseDir, ref.path))
+		if err != nil {
+			continue
+		}
+		value := make([]byte, 1+ref.length)
+		value[0] = CHUNK
+		_, err = file.ReadAt(value[1:], ref.offset)
+		file.Close()
+		if err != nil {
+			continue
+		}
+		if sum := sha256.Sum256(value); bytes.Equal(sum[:], hash) {
+			return value
+		}
+	}
+	return nil
+}
+
+// Record directory or big file node
+func (j *Journal) AddNode(hash []byte, value []byte) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if _, ok := j.nodes[string(hash)]; ok {
+		return
+	}
+	j.nodes[string(hash)] = value
+	j.write(fmt.Sprintf("node %s %s", hex.EncodeToString(hash), hex.EncodeToString(value)))
+}
+
+// Record chunk written to file at path
+func (j *Journal) AddChunk(hash []byte, path string, offset int64, length int) {
+	rel, err := filepath.Rel(j.baseDir, path)
+	if err != nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	ref := chunkRef{rel, offset, length}
+	for _, r := range j.chunks[string(hash)] {
+		if r == ref { // already recorded by a previous run
+			return
+		}
+	}
+	j.chunks[string(hash)] = append(j.chunks[string(hash)], ref)
+	j.files[rel] = true
+	j.write(fmt.Sprintf("chunk %s %d %d %s", hex.EncodeToString(hash), offset, length, rel))
+}
+
+// Does a file at path have chunks recorded (so it must not be truncated)
+func (j *Journal) HasFile(path string) bool {
+	rel, err := filepath.Rel(j.baseDir, path)
+	if err != nil {
+		return false
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.files[rel]
+}
+
+func (j *Journal) write(record string) {
+	if _, err := fmt.Fprintln(j.file, record); err != nil {
+		HandlePanicError(err, "Journal: write")
+	}
+}
+
+// Close journal, keeping it on disk for the next run
+func (j *Journal) Close() {
+	j.file.Close()
+}
+
+// Close and delete journal, once the download is complete
+func (j *Journal) Remove() {
+	j.file.Close()
+	err := os.Remove(j.path)
+	HandlePanicError(err, "Journal: remove")
+}
@@ -0,0 +1,118 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Records of an interrupted download are used again only if they still verify
+func TestJournalResume(t *testing.T) {
+	root := bytes.Repeat([]byte{9}, HASH_SIZE)
+	node := append([]byte{DIRECTORY}, make([]byte, NAME_SIZE+HASH_SIZE)...)
+	nodeHash := sha256.Sum256(node)
+	chunk := []byte("content of the file")
+	chunkHash := datumStore{}.add(append([]byte{CHUNK}, chunk...))
+
+	editJournal := func(edit func(string) string) func(t *testing.T, baseDir string) {
+		return func(t *testing.T, baseDir string) {
+			data, err := os.ReadFile(JournalPath(baseDir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(JournalPath(baseDir), []byte(edit(string(data))), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// replace " offset length path" of the chunk record
+	editChunk := func(record string) func(t *testing.T, baseDir string) {
+		return editJournal(func(s string) string {
+			return strings.Replace(s, hex.EncodeToString(chunkHash)+" 0 19 f", hex.EncodeToString(chunkHash)+record, 1)
+		})
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T, baseDir string)
+		root    []byte // of the download resumed
+		resumed bool
+		node    bool // node found again
+		chunk   bool // chunk found again
+		file    bool // the partial file is known to hold chunks
+	}{
+		{"intact", nil, root, true, true, true, true},
+		{"another download", nil, bytes.Repeat([]byte{8}, HASH_SIZE), false, false, false, false},
+		{"node value altered", editJournal(func(s string) string {
+			return strings.Replace(s, "node "+hex.EncodeToString(nodeHash[:])+" 02", "node "+hex.EncodeToString(nodeHash[:])+" 03", 1)
+		}), root, true, false, true, true},
+		{"partial file changed", func(t *testing.T, baseDir string) {
+			os.WriteFile(filepath.Join(baseDir, "f"), []byte("CONTENT of the file"), 0644)
+		}, root, true, true, false, true},
+		{"partial file removed", func(t *testing.T, baseDir string) {
+			os.Remove(filepath.Join(baseDir, "f"))
+		}, root, true, true, false, true},
+		{"last record cut by a crash", editJournal(func(s string) string {
+			return s[:len(s)-4]
+		}), root, true, true, false, false},
+		{"garbage lines", editJournal(func(s string) string {
+			return s + "chunk zz 0 1 f\nnode 00\nsomething else\n"
+		}), root, true, true, true, true},
+		{"negative length", editChunk(" 0 -5 f"), root, true, true, false, false},
+		{"length over a chunk", editChunk(fmt.Sprintf(" 0 %d f", CHUNK_SIZE+1)), root, true, true, false, false},
+		{"negative offset", editChunk(" -1 19 f"), root, true, true, false, false},
+		{"path out of the download", func(t *testing.T, baseDir string) {
+			os.WriteFile(filepath.Join(baseDir, "..", "outside"), chunk, 0644)
+			editChunk(" 0 19 ../outside")(t, baseDir)
+		}, root, true, true, false, false},
+		{"absolute path", func(t *testing.T, baseDir string) {
+			editChunk(" 0 19 "+filepath.Join(baseDir, "f"))(t, baseDir)
+		}, root, true, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseDir := filepath.Join(t.TempDir(), "download")
+			if err := os.MkdirAll(baseDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			j, _, err := OpenJournal(baseDir, root, OP_DOWNLOAD_HASH, "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			j.AddNode(nodeHash[:], node)
+			path := filepath.Join(baseDir, "f")
+			if err := os.WriteFile(path, chunk, 0644); err != nil {
+				t.Fatal(err)
+			}
+			j.AddChunk(chunkHash, path, 0, len(chunk))
+			j.Close()
+
+			if tt.tamper != nil {
+				tt.tamper(t, baseDir)
+			}
+			j, resumed, err := OpenJournal(baseDir, tt.root, OP_DOWNLOAD_HASH, "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer j.Close()
+			if resumed != tt.resumed {
+				t.Errorf("resumed %v, want %v", resumed, tt.resumed)
+			}
+			if got := j.Lookup(nodeHash[:]) != nil; got != tt.node {
+				t.Errorf("node found %v, want %v", got, tt.node)
+			}
+			if got := j.Lookup(chunkHash) != nil; got != tt.chunk {
+				t.Errorf("chunk found %v, want %v", got, tt.chunk)
+			}
+			if got := j.HasFile(path); got != tt.file {
+				t.Errorf("HasFile %v, want %v", got, tt.file)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package moduls
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// A key file must belong to us and be out of reach of the other users
+func checkKeyPermissions(info os.FileInfo) error {
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("permissions %04o are too open, it must be readable by its owner only (chmod 600)", perm)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("owned by uid %d, not by us", st.Uid)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package moduls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// File pinning the key first seen for each peer, like ssh's known_hosts: one line "name hex-key" per peer
+// (can be set by "known_peers=" in config, "known_peers=none" trusts whatever key the server gives)
+var KnownPeersFile = defaultKnownPeersFile()
+
+func defaultKnownPeersFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "betweenus", "known_peers")
+}
+
+var knownPeersMutex sync.Mutex
+
+// Check the key the server gives for peer against the one pinned for it, pinning it if it is the first one.
+// A key that differs from the pinned one (or no key where one was pinned) is reported loudly:
+// someone may stand between us and the server.
+// Return: the pinned key, and ErrKeyChanged if key is not that one
+func PinPeerKey(peer string, key []byte) ([]byte, error) {
+	if KnownPeersFile == "" {
+		return key, nil
+	}
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	known, err := loadKnownPeers()
+	if err != nil {
+		return nil, err
+	}
+	pinned, ok := known[peer]
+	switch {
+	case !ok && key == nil:
+		return nil, nil
+	case !ok:
+		known[peer] = key
+		if err := saveKnownPeers(known); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Key of peer %s pinned in %s\n", peer, KnownPeersFile)
+		return key, nil
+	case bytes.Equal(pinned, key):
+		return pinned, nil
+	}
+
+	now := hex.EncodeToString(key)
+	if key == nil {
+		now = "no key"
+	}
+	PrintError(fmt.Sprintf("WARNING: THE KEY OF PEER %s HAS CHANGED!\n"+
+		"  pinned: %x\n  now:    %s\n"+
+		"Someone may be impersonating it: signed exchanges with it are refused.\n"+
+		"If the change is expected, trust the new key (Trust %s) or forget the old one (Forget %s).",
+		peer, pinned, now, peer, peer))
+	return pinned, fmt.Errorf("peer %s: %w", peer, ErrKeyChanged)
+}
+
+// Key pinned for peer, nil if none is
+func PinnedPeerKey(peer string) ([]byte, error) {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	known, err := loadKnownPeers()
+	if err != nil {
+		return nil, err
+	}
+	return known[peer], nil
+}
+
+// Pin key for peer, replacing the key pinned before if any.
+// The key cached for it by a running process is dropped, so the new one is used at once.
+func TrustPeerKey(peer string, key []byte) error {
+	if len(key) != KEY_SIZE {
+		return fmt.Errorf("peer %s has no key to trust", peer)
+	}
+	if KnownPeersFile == "" {
+		return fmt.Errorf("no known_peers file")
+	}
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	known, err := loadKnownPeers()
+	if err != nil {
+		return err
+	}
+	known[peer] = key
+	if err := saveKnownPeers(known); err != nil {
+		return err
+	}
+	forgetCachedPeerKey(peer)
+	return nil
+}
+
+// Remove the key pinned for peer: the next key seen for it will be pinned, in this process too
+// Return: error if none was pinned
+func ForgetPeerKey(peer string) error {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	known, err := loadKnownPeers()
+	if err != nil {
+		return err
+	}
+	if _, ok := known[peer]; !ok {
+		return fmt.Errorf("no key pinned for peer %s", peer)
+	}
+	delete(known, peer)
+	if err := saveKnownPeers(known); err != nil {
+		return err
+	}
+	forgetCachedPeerKey(peer)
+	return nil
+}
+
+// Pinned keys, one line "name key" per peer in name order
+func KnownPeers() ([]string, error) {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	known, err := loadKnownPeers()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for peer, key := range known {
+		lines = append(lines, fmt.Sprintf("%s %x", peer, key))
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// Read KnownPeersFile, empty if it doesn't exist yet
+func loadKnownPeers() (map[string][]byte, error) {
+	known := map[string][]byte{}
+	if KnownPeersFile == "" {
+		return known, nil
+	}
+	file, err := os.Open(KnownPeersFile)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// names may contain spaces, keys don't
+		sep := strings.LastIndexByte(text, ' ')
+		key, err := hex.DecodeString(text[sep+1:])
+		if sep <= 0 || err != nil || len(key) != KEY_SIZE {
+			return nil, fmt.Errorf("%s:%d: expected \"name key\" with a key of %d hex bytes", KnownPeersFile, line, KEY_SIZE)
+		}
+		known[strings.TrimSpace(text[:sep])] = key
+	}
+	return known, scanner.Err()
+}
+
+// Write known to KnownPeersFile, replacing it at once
+func saveKnownPeers(known map[string][]byte) error {
+	peers := make([]string, 0, len(known))
+	for peer := range known {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	var content bytes.Buffer
+	for _, peer := range peers {
+		fmt.Fprintf(&content, "%s %x\n", peer, known[peer])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(KnownPeersFile), 0700); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", KnownPeersFile, os.Getpid())
+	if err := os.WriteFile(tmp, content.Bytes(), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, KnownPeersFile)
+}
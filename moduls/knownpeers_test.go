@@ -0,0 +1,168 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The first key seen for a peer is pinned; another key, or none, is refused until trusted or forgotten
+func TestPinPeerKey(t *testing.T) {
+	defer func(file string) { KnownPeersFile = file }(KnownPeersFile)
+	KnownPeersFile = filepath.Join(t.TempDir(), "conf", "known_peers")
+	a, _ := NewIdentity()
+	b, _ := NewIdentity()
+
+	steps := []struct {
+		name   string
+		do     func() ([]byte, error) // returns the key in use for the peer
+		pinned []byte
+		err    error
+	}{
+		{"no key, nothing pinned", func() ([]byte, error) { return PinPeerKey("my peer", nil) }, nil, nil},
+		{"first key", func() ([]byte, error) { return PinPeerKey("my peer", a.PublicKey()) }, a.PublicKey(), nil},
+		{"same key", func() ([]byte, error) { return PinPeerKey("my peer", a.PublicKey()) }, a.PublicKey(), nil},
+		{"other key", func() ([]byte, error) { return PinPeerKey("my peer", b.PublicKey()) }, a.PublicKey(), ErrKeyChanged},
+		{"key gone", func() ([]byte, error) { return PinPeerKey("my peer", nil) }, a.PublicKey(), ErrKeyChanged},
+		{"trusted", func() ([]byte, error) {
+			if err := TrustPeerKey("my peer", b.PublicKey()); err != nil {
+				return nil, err
+			}
+			return PinPeerKey("my peer", b.PublicKey())
+		}, b.PublicKey(), nil},
+		{"forgotten", func() ([]byte, error) {
+			if err := ForgetPeerKey("my peer"); err != nil {
+				return nil, err
+			}
+			return PinPeerKey("my peer", a.PublicKey())
+		}, a.PublicKey(), nil},
+	}
+	for _, step := range steps {
+		key, err := step.do()
+		if !bytes.Equal(key, step.pinned) || !errors.Is(err, step.err) {
+			t.Fatalf("%s: key %x, %v, want %x, %v", step.name, key, err, step.pinned, step.err)
+		}
+	}
+	if err := ForgetPeerKey("nobody"); err == nil {
+		t.Error("forgot a peer that had no key pinned")
+	}
+
+	info, err := os.Stat(KnownPeersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("known_peers written with mode %04o, want 0600", perm)
+	}
+}
+
+// Names may contain spaces and comments are skipped; a malformed line makes the file unusable
+func TestKnownPeersFile(t *testing.T) {
+	defer func(file string) { KnownPeersFile = file }(KnownPeersFile)
+	KnownPeersFile = filepath.Join(t.TempDir(), "known_peers")
+	a, _ := NewIdentity()
+	b, _ := NewIdentity()
+
+	content := fmt.Sprintf("# pinned keys\n\nzed %x\n  two words %x  \n", a.PublicKey(), b.PublicKey())
+	os.WriteFile(KnownPeersFile, []byte(content), 0600)
+	lines, err := KnownPeers()
+	want := []string{fmt.Sprintf("two words %x", b.PublicKey()), fmt.Sprintf("zed %x", a.PublicKey())}
+	if err != nil || !reflect.DeepEqual(lines, want) {
+		t.Errorf("KnownPeers = %q, %v, want %q", lines, err, want)
+	}
+
+	for _, line := range []string{"nokey", fmt.Sprintf("short %x", a.PublicKey()[1:]), "bad zz"} {
+		os.WriteFile(KnownPeersFile, []byte(line+"\n"), 0600)
+		if _, err := PinPeerKey("zed", a.PublicKey()); err == nil {
+			t.Errorf("%q accepted", line)
+		}
+	}
+}
+
+// A peer whose key changed is refused even when signatures are not strict
+func TestVerifyMessageKeyChanged(t *testing.T) {
+	defer func(file string, id *Identity, fetch func(string) ([]byte, error)) {
+		KnownPeersFile, FetchPeerKey = file, fetch
+		UseIdentity(id)
+		keysByAddr, keysByName = map[string]*ecdsa.PublicKey{}, map[string]*peerKey{}
+	}(KnownPeersFile, MyIdentity(), FetchPeerKey)
+	KnownPeersFile = filepath.Join(t.TempDir(), "known_peers")
+	keysByAddr, keysByName = map[string]*ecdsa.PublicKey{}, map[string]*peerKey{}
+	pinned, _ := NewIdentity()
+	impostor, _ := NewIdentity()
+	PinPeerKey("peer", pinned.PublicKey())
+
+	FetchPeerKey = func(string) ([]byte, error) { return impostor.PublicKey(), nil }
+	fetchKey("peer")
+	UseIdentity(impostor)
+	hello := NewHelloMessage(1, HELLO, 0, "peer")
+	signMessage(hello)
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+	if err := verifyMessage(hello, from); !errors.Is(err, ErrKeyChanged) {
+		t.Errorf("Hello signed by the new key: %v, want %v", err, ErrKeyChanged)
+	}
+}
+
+// Once the new key of a peer is trusted, its Hellos are accepted without waiting for KEY_RETRY
+func TestTrustPeerKeyApplies(t *testing.T) {
+	defer func(file string, id *Identity, fetch func(string) ([]byte, error)) {
+		KnownPeersFile, FetchPeerKey = file, fetch
+		UseIdentity(id)
+		keysByAddr, keysByName = map[string]*ecdsa.PublicKey{}, map[string]*peerKey{}
+	}(KnownPeersFile, MyIdentity(), FetchPeerKey)
+	KnownPeersFile = filepath.Join(t.TempDir(), "known_peers")
+	keysByAddr, keysByName = map[string]*ecdsa.PublicKey{}, map[string]*peerKey{}
+	old, _ := NewIdentity()
+	renewed, _ := NewIdentity()
+	PinPeerKey("peer", old.PublicKey())
+
+	FetchPeerKey = func(string) ([]byte, error) { return renewed.PublicKey(), nil }
+	UseIdentity(renewed)
+	hello := NewHelloMessage(1, HELLO, 0, "peer")
+	signMessage(hello)
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+	fetchKey("peer")
+	if err := verifyMessage(hello, from); !errors.Is(err, ErrKeyChanged) {
+		t.Fatalf("Hello signed by the new key: %v, want %v", err, ErrKeyChanged)
+	}
+	if err := TrustPeerKey("peer", renewed.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	fetchKey("peer")
+	if err := verifyMessage(hello, from); err != nil {
+		t.Errorf("Hello signed by the trusted key: %v", err)
+	}
+}
+
+// When the server can't give the key of a peer, the pinned key is used: the peer is still reached
+func TestPinnedKeyWithoutServer(t *testing.T) {
+	defer func(file string, id *Identity, fetch func(string) ([]byte, error), strict bool) {
+		KnownPeersFile, FetchPeerKey, StrictSignatures = file, fetch, strict
+		UseIdentity(id)
+		keysByAddr, keysByName = map[string]*ecdsa.PublicKey{}, map[string]*peerKey{}
+	}(KnownPeersFile, MyIdentity(), FetchPeerKey, StrictSignatures)
+	KnownPeersFile = filepath.Join(t.TempDir(), "known_peers")
+	keysByAddr, keysByName = map[string]*ecdsa.PublicKey{}, map[string]*peerKey{}
+	StrictSignatures = true
+
+	// both ends are this process, with the same key
+	id, _ := NewIdentity()
+	UseIdentity(id)
+	PinPeerKey("me", id.PublicKey())
+	PinPeerKey("peer", id.PublicKey())
+	FetchPeerKey = func(string) ([]byte, error) { return nil, errors.New("server unreachable") }
+
+	conn := serveTree(t, Merkelify(writeShare(t, map[string][]byte{"f": nil})))
+	if ok, err := sendHello(conn, nil, "me"); !ok {
+		t.Fatalf("Hello to a pinned peer: %v", err)
+	}
+	if pinned, _ := PinnedPeerKey("peer"); !bytes.Equal(pinned, id.PublicKey()) {
+		t.Errorf("pinned key %x, want %x", pinned, id.PublicKey())
+	}
+}
@@ -0,0 +1,121 @@
+package moduls
+
+import (
+	"errors"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+)
+
+// What Merkelify does with the symbolic links of a share (set by "symlinks=" in config)
+const (
+	SYMLINKS_SKIP     = iota // leave them out
+	SYMLINKS_IN_SHARE        // publish what they point to if it is inside the share
+	SYMLINKS_FOLLOW          // publish what they point to wherever it is
+)
+
+// Policy for symbolic links, one of SYMLINKS_*.
+// Files below a followed link are not watched: their changes are seen when the share is built again.
+var SymlinkPolicy = SYMLINKS_IN_SHARE
+
+// What a directory being hashed inherits from the directories above it
+type dirScope struct {
+	rules  *ignoreRules // for its entries
+	real   string       // path of the directory with symbolic links resolved, to detect loops
+	parent *dirScope
+}
+
+// Scope above the root of a share
+func rootScope() *dirScope {
+	return &dirScope{rules: rootIgnoreRules()}
+}
+
+// Scope of directory at path (rel relative to the share root), an entry of the directory of s
+func (s *dirScope) enter(path string, rel string) *dirScope {
+	real := s.real + "/" + gopath.Base(path)
+	if info, err := os.Lstat(path); s.real == "" || err != nil || info.Mode()&os.ModeSymlink != 0 {
+		real = realPath(path)
+	}
+	return &dirScope{rules: s.rules.forDir(path, rel), real: real, parent: s}
+}
+
+// Would following a link to directory target come back to a directory being hashed
+func (s *dirScope) loops(target string) bool {
+	for d := s; d != nil && d.real != ""; d = d.parent {
+		if isWithin(d.real, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Absolute path of path with symbolic links resolved, path itself if it can't be resolved
+func realPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real
+	}
+	return abs
+}
+
+// Is path dir or below it
+func isWithin(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// Decide how entry de of the directory of scope, at path, is published, following the symlink policy.
+// Devices, sockets, pipes, broken links and links out of the policy are left out.
+// Return: is it published, and as a directory or as a file
+func (b *treeBuilder) resolve(path string, de os.DirEntry, scope *dirScope) (ok bool, isDir bool) {
+	mode := de.Type()
+	if mode&os.ModeSymlink != 0 {
+		if SymlinkPolicy == SYMLINKS_SKIP {
+			b.ignore(b.rel(path) + " (symbolic link)")
+			return false, false
+		}
+		target, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			target, err = filepath.Abs(target)
+		}
+		if err != nil {
+			b.skip(path, "broken symbolic link: "+errorReason(err))
+			return false, false
+		}
+		if SymlinkPolicy == SYMLINKS_IN_SHARE && !isWithin(target, b.real) {
+			b.skip(path, "symbolic link out of the share to "+target)
+			return false, false
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			b.skip(path, errorReason(err))
+			return false, false
+		}
+		if info.IsDir() && scope.loops(target) {
+			b.skip(path, "symbolic link loop to "+target)
+			return false, false
+		}
+		mode = info.Mode().Type()
+	}
+
+	switch {
+	case mode.IsDir():
+		return true, true
+	case mode.IsRegular():
+		return true, false
+	}
+	b.skip(path, "not a regular file (device, socket or pipe)")
+	return false, false
+}
+
+// Why an operation on a file failed, without the file name PathError adds
+func errorReason(err error) string {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Op + ": " + pathErr.Err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,69 @@
+package moduls
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+// Names published under directory node n, split directories put back together
+func publishedNames(n Node) []string {
+	var names []string
+	for _, c := range flattenDirectory(n.Children) {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Links are published or left out following the policy, never looping, and special files are left out
+func TestSymlinkPolicy(t *testing.T) {
+	defer func(policy int) { SymlinkPolicy = policy }(SymlinkPolicy)
+
+	outside := writeShare(t, map[string][]byte{"secret": []byte("s")})
+	share := writeShare(t, map[string][]byte{"d/e/f": []byte("f")})
+	for link, target := range map[string]string{
+		"d/e/up":   "..",         // loops
+		"root":     "/",          // loops, and out of the share
+		"out":      outside,      // out of the share
+		"dir":      "d/e",        // directory in the share
+		"file":     "d/e/f",      // file in the share
+		"broken":   "nowhere",    // nothing there
+		"selfloop": "selfloop",   // can't be resolved
+		"d/e/back": "../../file", // link to a link
+	} {
+		if err := os.Symlink(target, filepath.Join(share, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mkfifo(filepath.Join(share, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		policy int
+		top    []string // published at the root
+		e      []string // published in d/e
+	}{
+		{"skip", SYMLINKS_SKIP, []string{"d"}, []string{"f"}},
+		{"share", SYMLINKS_IN_SHARE, []string{"d", "dir", "file"}, []string{"back", "f"}},
+		{"follow", SYMLINKS_FOLLOW, []string{"d", "dir", "file", "out"}, []string{"back", "f"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SymlinkPolicy = tt.policy
+			root, _ := build(share)
+			if got := publishedNames(root); !reflect.DeepEqual(got, tt.top) {
+				t.Errorf("published %v, want %v", got, tt.top)
+			}
+			e := flattenDirectory(flattenDirectory(root.Children)[0].Children)[0]
+			if got := publishedNames(e); !reflect.DeepEqual(got, tt.e) {
+				t.Errorf("published in d/e %v, want %v", got, tt.e)
+			}
+		})
+	}
+}
@@ -1,84 +1,475 @@
 package moduls
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	gopath "path"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Node struct {
 	Name     string
 	NodeType int64
 	Offset   int64
+	Path     string // file or directory on disk the node was made from
 	Hash     []byte
 	Children []Node
 }
 
+// Directories with more than MAX_DIR_ENTRIES entries are split into nested directory nodes whose names start with
+// this prefix. Their entries belong to the directory above: DownloadData puts them back there.
+// Real entries with such a name can't be published.
+const SPLIT_DIR_PREFIX = ".betweenus-part-"
+
+// Number of files hashed at the same time (can be set by "hash_workers=" in config)
+var HashWorkers = runtime.NumCPU()
+
+// State of one build of the tree
+type treeBuilder struct {
+	root    string // path of the share
+	real    string // path of the share with symbolic links resolved
+	cache   *HashCache
+	workers chan struct{} // one token per file being read
+	start   time.Time
+	bytes   atomic.Int64 // read from disk
+
+	mutex       sync.Mutex
+	unpublished []string // paths left out of the tree, and why
+	ignored     []string // paths left out by the ignore rules, relative to the share
+}
+
+func newTreeBuilder(path string) *treeBuilder {
+	workers := HashWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	cache := ShareHashCache(path)
+	cache.takeCounts() // report only this build
+	return &treeBuilder{
+		root:    path,
+		real:    realPath(path),
+		cache:   cache,
+		workers: make(chan struct{}, workers),
+		start:   time.Now(),
+	}
+}
+
 // TODO directory/file ==> merkel tree
+// The tree built is also indexed and becomes the one served to peers (see ShareTree)
 func Merkelify(path string) (root Node) {
-	info, err := os.Stat(path)
-	HandlePanicError(err, "os.stat error, merkelify")
+	r, b := build(path)
 
-	var r Node
+	// if LOG_PRINT_DATA {
+	// 	PrintMerkelTree(r, " ")
+	// }
 
+	b.finish(r, true)
+	ShareTree(&r)
+	return r
+}
+
+// Build the tree of the share at path
+func build(path string) (Node, *treeBuilder) {
+	b := newTreeBuilder(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		b.skip(path, errorReason(err))
+		return b.orEmpty(Node{}), b
+	}
 	if info.IsDir() {
-		r = hashDir(path)
-	} else {
-		r = hashFile(path)
+		return b.orEmpty(b.hashDir(path, rootScope())), b
 	}
+	return b.orEmpty(b.hashFile(path)), b
+}
 
-	// if LOG_PRINT_DATA {
-	// 	PrintMerkelTree(r, " ")
-	// }
+// Tree of the share: root, or an empty directory if the root could not be read
+func (b *treeBuilder) orEmpty(root Node) Node {
+	if root.Hash != nil {
+		return root
+	}
+	return Node{
+		Name:     gopath.Base(b.root),
+		NodeType: DIRECTORY,
+		Path:     b.root,
+		Hash:     directoryHash(nil),
+	}
+}
+
+// Print what Merkelify would publish from path, the root hash, and what is left out, without serving it
+func DryRun(path string) {
+	r, b := build(path)
+
+	fmt.Printf("Would publish %s:\n", path)
+	b.dryRun(r, "")
+	fmt.Printf("Root: %x\n", r.Hash)
+}
+
+// Print the entries of tree r, under prefix, and what was left out of it
+func (b *treeBuilder) dryRun(r Node, prefix string) {
+	printPublished(r, prefix)
+	if len(b.ignored) > 0 {
+		sort.Strings(b.ignored)
+		fmt.Printf("Ignored:\n  %s\n", strings.Join(b.ignored, "\n  "))
+	}
+	if renamed := renamedEntries(r); len(renamed) > 0 {
+		fmt.Printf("Published under a shorter name:\n  %s\n", strings.Join(renamed, "\n  "))
+	}
+	b.warn(b.root)
+}
+
+// Print entries of tree as peers will see them once split directories are put back together
+func printPublished(n Node, path string) {
+	switch n.NodeType {
+	case DIRECTORY:
+		fmt.Printf("  %x  %s/\n", n.Hash, path)
+		for _, child := range flattenDirectory(n.Children) {
+			printPublished(child, path+"/"+child.Name)
+		}
+	default:
+		fmt.Printf("  %x  %s\n", n.Hash, path)
+	}
+}
+
+// Rebuild tree after the paths in dirty changed on disk (modified, created or deleted).
+// Dirty paths are hashed again, the directories above them get new nodes,
+// everything else is taken from old as is.
+// old can be a single share (as built by Merkelify) or several (as built by MerkelifyShares).
+// The new tree becomes the one served to peers.
+func Rehash(old Node, dirty []string) Node {
+	// new ignore rules: the whole directory is looked at again
+	for _, p := range dirty {
+		if dir, ok := strings.CutSuffix(p, "/"+IGNORE_FILE); ok {
+			dirty = append(dirty, dir)
+		}
+	}
+
+	var r Node
+	if isSharesRoot(old) {
+		mounts := flattenDirectory(old.Children)
+		for i, m := range mounts {
+			mounts[i] = mount(m.Name, rehashShare(m, dirty))
+		}
+		r = sharesRoot(mounts)
+	} else {
+		r = rehashShare(old, dirty)
+	}
+	ShareTree(&r)
+	return r
+}
 
+// Rebuild the tree of one share
+func rehashShare(old Node, dirty []string) Node {
+	b := newTreeBuilder(old.Path)
+	r := b.orEmpty(b.rehash(old, dirty, rootScope()))
+	b.finish(r, false)
 	return r
 }
 
-// PS: this only includes the first 16 items in the directory
-func hashDir(path string) Node {
-	var child Node
-	child.NodeType = DIRECTORY
-	dir, err := os.ReadDir(path)
-	HandlePanicError(err, "os.readdir err, hashDir")
+func (b *treeBuilder) rehash(old Node, dirty []string, parent *dirScope) Node {
+	changed, below := false, false
+	for _, p := range dirty {
+		changed = changed || p == old.Path
+		below = below || strings.HasPrefix(p, old.Path+"/")
+	}
+	if !changed && !below {
+		return old
+	}
+
+	info, err := os.Stat(old.Path)
+	if err != nil {
+		b.skip(old.Path, errorReason(err))
+		return Node{}
+	}
+	switch {
+	case changed && info.IsDir():
+		return b.hashDir(old.Path, parent)
+	case changed:
+		return b.hashFile(old.Path)
+	case old.NodeType != DIRECTORY || !info.IsDir():
+		return old
+	}
 
-	// if empty directory just Hash the path and return
-	if len(dir) == 0 {
-		cHash := sha256.New()
-		cHash.Write([]byte(path))
-		child = Node{
-			Name:     gopath.Base(path),
-			Hash:     cHash.Sum(nil),
-			NodeType: DIRECTORY,
+	previous := map[string]Node{} // by name on disk
+	for _, n := range flattenDirectory(old.Children) {
+		previous[gopath.Base(n.Path)] = n
+	}
+
+	child := Node{
+		Name:     old.Name,
+		NodeType: DIRECTORY,
+		Path:     old.Path,
+	}
+	dir, err := os.ReadDir(old.Path)
+	if err != nil {
+		b.skip(old.Path, errorReason(err))
+		return Node{}
+	}
+	scope := parent.enter(old.Path, b.rel(old.Path))
+
+	var jobs []func() Node
+	for _, de := range dir {
+		filePath := old.Path + "/" + de.Name()
+		admitted, isDir := b.admit(filePath, de, scope)
+		if !admitted {
+			continue
 		}
+		prev, ok := previous[de.Name()]
+		switch {
+		case ok && (prev.NodeType == DIRECTORY) == isDir:
+			jobs = append(jobs, func() Node { return b.rehash(prev, dirty, scope) })
+		case isDir:
+			jobs = append(jobs, func() Node { return b.hashDir(filePath, scope) })
+		default:
+			jobs = append(jobs, func() Node { return b.hashFile(filePath) })
+		}
+	}
+	entries := b.collect(jobs)
+	publishNames(entries)
+
+	child.Children = splitDirectory(old.Path, entries)
+	child.Hash = directoryHash(child.Children)
+	return child
+}
+
+// Run jobs concurrently (the reading of files is bounded by HashWorkers)
+// Return: the nodes built, in the order of jobs whatever the order they were done in,
+// without the empty nodes of the entries that could not be read
+func (b *treeBuilder) collect(jobs []func() Node) []Node {
+	nodes := make([]Node, len(jobs))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job func() Node) {
+			defer wg.Done()
+			nodes[i] = job()
+		}(i, job)
+	}
+	wg.Wait()
+
+	built := nodes[:0]
+	for _, n := range nodes {
+		if n.Hash != nil {
+			built = append(built, n)
+		}
+	}
+	return built
+}
+
+// Report on the build of tree r and save what is kept between runs.
+// full: r was built from scratch, not rehashed from a previous tree.
+func (b *treeBuilder) finish(r Node, full bool) {
+	b.warn(b.root)
+	if full {
+		b.report(b.root)
+	}
+	b.cache.Save(full)
+	saveNameMap(r)
+}
+
+// Print how many files were hashed, at what throughput, and how many were taken from the hash cache
+func (b *treeBuilder) report(path string) {
+	hits, hashed, stale := b.cache.takeCounts()
+	elapsed := time.Since(b.start)
+	mb := float64(b.bytes.Load()) / (1 << 20)
+	fmt.Printf("Share %s: %d files hashed, %.1f MB in %v (%.1f MB/s, %d workers), %d reused from the hash cache\n",
+		path, hashed, mb, elapsed.Round(time.Millisecond), mb/elapsed.Seconds(), cap(b.workers), hits)
+	if stale > 0 {
+		UnexpectedMessage(fmt.Sprintf("Warning: %d files of %s had wrong hashes in the hash cache", stale, path))
+	}
+}
+
+// Print the list of what was left out of the tree of path
+func (b *treeBuilder) warn(path string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	sort.Strings(b.unpublished)
+	if len(b.unpublished) > 0 {
+		UnexpectedMessage(fmt.Sprintf("Warning: %d entries of %s could not be published:\n  %s",
+			len(b.unpublished), path, strings.Join(b.unpublished, "\n  ")))
+	}
+}
+
+// Path relative to the share, "" for its root
+func (b *treeBuilder) rel(path string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path, b.root), "/")
+}
+
+// Should entry de of the directory of scope, at path, be in the tree
+// Return: is it, and as a directory or as a file (see resolve)
+func (b *treeBuilder) admit(path string, de os.DirEntry, scope *dirScope) (ok bool, isDir bool) {
+	if scope.rules.Ignored(b.rel(path), de.IsDir()) {
+		b.ignore(b.rel(path))
+		return false, false
+	}
+	if problem := nameProblem(de.Name()); problem != "" {
+		b.skip(fmt.Sprintf("%q", path), problem)
+		return false, false
 	}
+	if isSplitDirectory(de.Name()) {
+		b.skip(path, "name reserved for split directories")
+		return false, false
+	}
+	return b.resolve(path, de, scope)
+}
+
+// Record entry at rel (relative to the share) as left out on purpose
+func (b *treeBuilder) ignore(rel string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.ignored = append(b.ignored, rel)
+}
+
+// Record entry at path as left out because it could not be published
+func (b *treeBuilder) skip(path string, reason string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.unpublished = append(b.unpublished, fmt.Sprintf("%s: %s", path, reason))
+}
+
+// Hash directory and everything below it, its entries concurrently.
+// Entries are taken in name order (as given by os.ReadDir), so the same content always gives the same tree.
+// parent is the scope of the directory above, whose ignore rules are extended by those of the directory.
+// Return: an empty node if the directory can't be read
+func (b *treeBuilder) hashDir(path string, parent *dirScope) Node {
+	child := Node{
+		Name:     gopath.Base(path),
+		NodeType: DIRECTORY,
+		Path:     path,
+	}
+	dir, err := os.ReadDir(path)
+	if err != nil {
+		b.skip(path, errorReason(err))
+		return Node{}
+	}
+	scope := parent.enter(path, b.rel(path))
 
-	for i, de := range dir {
+	var jobs []func() Node
+	for _, de := range dir {
 		filePath := path + "/" + de.Name()
-		if de.IsDir() {
-			child.Children = append(child.Children, hashDir(filePath))
+		admitted, isDir := b.admit(filePath, de, scope)
+		if !admitted {
+			continue
+		}
+		if isDir {
+			jobs = append(jobs, func() Node { return b.hashDir(filePath, scope) })
 		} else {
-			child.Children = append(child.Children, hashFile(filePath))
+			jobs = append(jobs, func() Node { return b.hashFile(filePath) })
 		}
+	}
+	entries := b.collect(jobs)
+	publishNames(entries)
 
-		// break after 16 items
-		if i == 15 {
-			break
+	// an empty directory is hashed as a directory without entries
+	child.Children = splitDirectory(path, entries)
+	child.Hash = directoryHash(child.Children)
+	return child
+}
+
+// Group the entries of a directory level by level into nested directory nodes of at most MAX_DIR_ENTRIES entries,
+// spread evenly as the chunks of a big file are, until they fit in one directory node.
+// The nodes added are named SPLIT_DIR_PREFIX + their rank among their siblings.
+// Return: the entries of the directory node itself
+func splitDirectory(path string, entries []Node) []Node {
+	level := entries
+	for len(level) > MAX_DIR_ENTRIES {
+		groups := (len(level) + MAX_DIR_ENTRIES - 1) / MAX_DIR_ENTRIES
+		next := make([]Node, 0, groups)
+
+		start := 0
+		for g := 0; g < groups; g++ {
+			size := len(level) / groups
+			if g < len(level)%groups {
+				size++
+			}
+			children := level[start : start+size]
+			start += size
+
+			next = append(next, Node{
+				Name:     fmt.Sprintf("%s%02d", SPLIT_DIR_PREFIX, g),
+				NodeType: DIRECTORY,
+				Path:     path,
+				Hash:     directoryHash(children),
+				Children: children,
+			})
 		}
+		level = next
 	}
-	child.Hash = calculateNodeHash(child.Children)
-	return child
+	return level
 }
 
-func hashFile(path string) Node {
+// Entries of a directory node, with the parts added by splitDirectory taken apart
+func flattenDirectory(children []Node) []Node {
+	var entries []Node
+	for _, n := range children {
+		if n.NodeType == DIRECTORY && isSplitDirectory(n.Name) {
+			entries = append(entries, flattenDirectory(n.Children)...)
+		} else {
+			entries = append(entries, n)
+		}
+	}
+	return entries
+}
+
+// Is entry of a directory a part of it, added by splitDirectory
+func isSplitDirectory(name string) bool {
+	return strings.HasPrefix(name, SPLIT_DIR_PREFIX)
+}
+
+// Hash file, or take its hashes from the hash cache if it didn't change since they were computed
+// Return: an empty node if the file can't be read
+func (b *treeBuilder) hashFile(path string) Node {
+	info, err := os.Stat(path)
+	if err != nil {
+		b.skip(path, errorReason(err))
+		return Node{}
+	}
+	if !info.Mode().IsRegular() {
+		b.skip(path, "not a regular file (device, socket or pipe)")
+		return Node{}
+	}
 
-	// child to be returned
-	var child Node
+	if !ForceRehash {
+		if leaves, inner, root := b.cache.Get(path, info); leaves != nil {
+			nodes := make([]Node, len(leaves))
+			for i, hash := range leaves {
+				nodes[i] = chunkNode(path, int64(i), hash)
+			}
+			// the BIG_FILE nodes take their cached hashes if there is one for each, else are hashed again
+			hash := bigFileHash
+			if len(inner) == bigFileCount(len(nodes))*HASH_SIZE {
+				hash = func([]Node) []byte {
+					h := inner[:HASH_SIZE]
+					inner = inner[HASH_SIZE:]
+					return h
+				}
+			}
+			// in snapshot mode the chunks must be in the store too, whatever gave their hashes
+			if child := buildBTree(nodes, hash); bytes.Equal(child.Hash, root) && snapshotChunks(path, leaves) {
+				child.Name = gopath.Base(path)
+				child.Path = path
+				return child
+			}
+		}
+	}
+
+	// wait for a worker
+	b.workers <- struct{}{}
+	defer func() { <-b.workers }()
+	hashed := time.Now()
 
 	file, err := os.Open(path)
-	HandleFatalError(err, "error opening file "+path)
+	if err != nil {
+		b.skip(path, errorReason(err))
+		return Node{}
+	}
 	defer file.Close()
 
 	// making the hashes
@@ -88,143 +479,183 @@ func hashFile(path string) Node {
 	// Hash entire file and create nodes
 	var i int64
 	for {
-		node := Node{
-			Name:     fmt.Sprintf("%s/%d", path, i),
-			Children: nil,
-			Offset:   i * CHUNK_SIZE,
-			NodeType: CHUNK,
-		}
-
-		n, err := file.Read(chunk)
+		n, err := io.ReadFull(file, chunk)
 		if err == io.EOF {
 			break
 		}
-		HandleFatalError(err, "error reading "+path)
+		if err != nil && err != io.ErrUnexpectedEOF { // last chunk is shorter
+			b.skip(path, errorReason(err))
+			return Node{}
+		}
 
-		tempHash := sha256.New()
-		tempHash.Write(chunk[:n])
-		node.Hash = tempHash.Sum(nil)
+		node := chunkNode(path, i, chunkHash(chunk[:n]))
+		if Snapshots != nil {
+			Snapshots.Put(node.Hash, append([]byte{CHUNK}, chunk[:n]...))
+		}
 		nodes = append(nodes, node)
+		b.bytes.Add(int64(n))
 		i++
+
+		if n < CHUNK_SIZE {
+			break
+		}
 	}
 
-	if len(nodes) < 2 {
-		child.NodeType = CHUNK
-	} else {
-		child.NodeType = BIG_FILE
+	// an empty file is a single empty chunk
+	if len(nodes) == 0 {
+		nodes = append(nodes, chunkNode(path, 0, chunkHash(nil)))
 	}
 
-	child = makeBTree(nodes)
+	var inner []byte
+	child := buildBTree(nodes, func(children []Node) []byte {
+		h := bigFileHash(children)
+		inner = append(inner, h...)
+		return h
+	})
 	child.Name = gopath.Base(path)
+	child.Path = path
+	b.cache.Put(path, info, hashed, nodes, inner, child.Hash)
 	return child
 }
 
-// we are required to provide sources on code so for this one i did ask a friend for some help here (Mr. Scruff), just hints, not actual code
-
-//Natalia: If file is bigger than 32KB this code fails!
-//probably problem is in
-// > for start := 0; start < len(sortedNodes); start += perNode {
-func makeBTree(sortedNodes []Node) Node {
-	if len(sortedNodes) == 0 {
-		return Node{}
+// Put in the snapshot store the chunks of file at path it lacks, read again and checked against leaves, their hashes.
+// Return: false if one of them changed, true if all are stored or the snapshot mode is off
+func snapshotChunks(path string, leaves [][]byte) bool {
+	if Snapshots == nil {
+		return true
 	}
-
-	// leaf Node
-	if len(sortedNodes) <= MAX_CHILDREN {
-		return Node{Children: sortedNodes}
+	for i, hash := range leaves {
+		if Snapshots.Has(hash) {
+			continue
+		}
+		data, err := readChunk(path, int64(i)*CHUNK_SIZE)
+		if err != nil || !bytes.Equal(chunkHash(data), hash) {
+			return false
+		}
+		Snapshots.Put(hash, append([]byte{CHUNK}, data...))
 	}
+	return true
+}
 
-	// internal Node
-	var internalNode Node
-	internalNode.Name = "/InternalNode"
-	internalNode.Hash = calculateNodeHash(sortedNodes)
-	internalNode.NodeType = BIG_FILE
+// Node of the i-th chunk of file at path
+func chunkNode(path string, i int64, hash []byte) Node {
+	return Node{
+		Name:     fmt.Sprintf("%s/%d", path, i),
+		Offset:   i * CHUNK_SIZE,
+		NodeType: CHUNK,
+		Path:     path,
+		Hash:     hash,
+	}
+}
 
-	// the max Children - 1 can just be done with a +1 outside but complicating things is fun
-	perNode := (len(sortedNodes) + MAX_CHILDREN - 1) / MAX_CHILDREN
+// Build the BIG_FILE nodes above the chunks of a file, level by level.
+// Each level groups the nodes of the level below into as few nodes of at most MAX_CHILDREN children as possible,
+// spreading them evenly: with more than MAX_CHILDREN nodes every group gets at least MAX_CHILDREN/2 of them,
+// so no BIG_FILE ever has less than 2 children, however large the file.
+// A file of a single chunk is that chunk.
+// The hash of each BIG_FILE node is given by hash from its children (see bigFileHash).
+// Nodes are built from the lowest level up, left to right in each level.
+func buildBTree(sortedNodes []Node, hash func(children []Node) []byte) Node {
+	if len(sortedNodes) == 0 {
+		return Node{}
+	}
 
-	for start := 0; start < len(sortedNodes); start += perNode {
-		end := (start + 1) * perNode
-		if end > len(sortedNodes) {
-			end = len(sortedNodes)
+	level := sortedNodes
+	for len(level) > 1 {
+		groups := (len(level) + MAX_CHILDREN - 1) / MAX_CHILDREN
+		next := make([]Node, 0, groups)
+
+		start := 0
+		for g := 0; g < groups; g++ {
+			// the first len%groups groups take one node more
+			size := len(level) / groups
+			if g < len(level)%groups {
+				size++
+			}
+			children := level[start : start+size]
+			start += size
+
+			next = append(next, Node{
+				Name:     "/InternalNode",
+				NodeType: BIG_FILE,
+				Offset:   children[0].Offset,
+				Path:     children[0].Path,
+				Hash:     hash(children),
+				Children: children,
+			})
 		}
-		child := makeBTree(sortedNodes[start:end])
-		internalNode.Children = append(internalNode.Children, child)
+		level = next
 	}
-	internalNode.Offset = internalNode.Children[0].Offset
-
-	return internalNode
+	return level[0]
 }
 
-// to get the Children's Hash
-func calculateNodeHash(nodes []Node) []byte {
-	Hash := sha256.New()
-	for _, n := range nodes {
-		Hash.Write(n.Hash)
+// Number of BIG_FILE nodes buildBTree builds above n chunks
+func bigFileCount(n int) int {
+	count := 0
+	for n > 1 {
+		n = (n + MAX_CHILDREN - 1) / MAX_CHILDREN
+		count += n
 	}
-	return Hash.Sum(nil)
+	return count
 }
 
-// search for specific Hash in the tree
-func getHash(root Node, targetHash []byte) (node *Node, value []byte) {
-
-	if compareHash(root.Hash, targetHash) {
-		path := strings.TrimSuffix(root.Name, "/")
-		var data []byte
-
-		if root.NodeType == DIRECTORY {
-			dir := make([]byte, (len(root.Children)+1)*64)
-
-			for i, child := range root.Children {
-				base_idx := i * 64
-				copy(dir[base_idx:base_idx+32], []byte(child.Name))
-				copy(dir[base_idx+32:base_idx+64], child.Hash)
-			}
-
-			copy(data, dir)
-		} else if root.NodeType == BIG_FILE {
-			file := make([]byte, (len(root.Children)+1)*32)
+// Hash of a chunk, as peers hash its Datum value: sha256(type CHUNK + data)
+func chunkHash(data []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{CHUNK})
+	hash.Write(data)
+	return hash.Sum(nil)
+}
 
-			for i, child := range root.Children {
-				base_idx := i * 32
-				copy(file[base_idx:base_idx+32], []byte(child.Hash))
-			}
+// Hash of a big file, as peers hash its Datum value: sha256(type BIG_FILE + hashes of children)
+func bigFileHash(children []Node) []byte {
+	hash := sha256.Sum256(bigFileValue(children))
+	return hash[:]
+}
 
-			copy(data, file)
-		} else {
-			data = getDataWithOffset(path, root.Offset)
-		}
-		return &root, data
-	}
+// Hash of a directory, as peers hash its Datum value: sha256(type DIRECTORY + entries)
+func directoryHash(children []Node) []byte {
+	hash := sha256.Sum256(directoryValue(children))
+	return hash[:]
+}
 
-	for _, child := range root.Children {
-		result, data := getHash(child, targetHash)
-		if result != nil {
-			return result, data
-		}
+// Datum value of a big file: type BIG_FILE followed by the hashes of its children
+func bigFileValue(children []Node) []byte {
+	value := make([]byte, 1, 1+len(children)*HASH_SIZE)
+	value[0] = BIG_FILE
+	for _, child := range children {
+		value = append(value, child.Hash...)
 	}
-
-	return nil, nil
+	return value
 }
 
-func compareHash(hash1, hash2 []byte) bool {
-	return fmt.Sprintf("%x", hash1) == fmt.Sprintf("%x", hash2)
+// Datum value of a directory: type DIRECTORY followed by one entry per child,
+// its name padded with NUL bytes to NAME_SIZE then its hash (names were made to fit by publishNames)
+func directoryValue(children []Node) []byte {
+	value := make([]byte, 1+len(children)*DIR_ENTRY_SIZE)
+	value[0] = DIRECTORY
+	for i, child := range children {
+		entry := value[1+i*DIR_ENTRY_SIZE : 1+(i+1)*DIR_ENTRY_SIZE]
+		copy(entry[:NAME_SIZE], child.Name)
+		copy(entry[NAME_SIZE:], child.Hash)
+	}
+	return value
 }
 
-// opens file at `path“ and returns the first 1024 bytes found at `Offset`
-func getDataWithOffset(path string, Offset int64) []byte {
+// Read the chunk of file at path that starts at offset: CHUNK_SIZE bytes, less for the last chunk
+func readChunk(path string, offset int64) ([]byte, error) {
 	file, err := os.Open(path)
-	HandlePanicError(err, fmt.Sprintf("error opening file %s", path))
-
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
-	_, err = file.Seek(Offset, 0)
-	HandlePanicError(err, fmt.Sprintf("error seeking to Offset %d in file %s", Offset, path))
 
-	buffer := make([]byte, 1024)
-	n, err := file.Read(buffer)
-	HandlePanicError(err, fmt.Sprintf("error reading from file %s @ Offset %d", path, Offset))
-
-	return buffer[:n]
+	buffer := make([]byte, CHUNK_SIZE)
+	n, err := file.ReadAt(buffer, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buffer[:n], nil
 }
 
 // print merkel
@@ -0,0 +1,135 @@
+package moduls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Every BIG_FILE node must have 2 to MAX_CHILDREN children
+func checkBigFileShape(t *testing.T, n Node) {
+	t.Helper()
+	if n.NodeType != BIG_FILE {
+		return
+	}
+	if len(n.Children) < 2 || len(n.Children) > MAX_CHILDREN {
+		t.Errorf("BIG_FILE with %d children", len(n.Children))
+	}
+	for _, c := range n.Children {
+		checkBigFileShape(t, c)
+	}
+}
+
+// Every DIRECTORY node must have at most MAX_DIR_ENTRIES entries
+func checkDirShape(t *testing.T, n Node) {
+	t.Helper()
+	if n.NodeType != DIRECTORY {
+		return
+	}
+	if len(n.Children) > MAX_DIR_ENTRIES {
+		t.Errorf("DIRECTORY with %d entries", len(n.Children))
+	}
+	for _, c := range n.Children {
+		checkDirShape(t, c)
+	}
+}
+
+// Roots of files of testContent, as a peer hashes them from the protocol:
+// a chunk hashes as sha256(0 | data), a big file as sha256(1 | hashes of children)
+func TestFileRoots(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		chunks int
+		root   string
+	}{
+		{1, "47355d0fb278dd2d1fc40f7f4f177e00571b886a5cc04291bb28d5dc53d3c2f6"},
+		{32, "65dff4cf04106ae3e4e5c3fef117143ac42d17f06f6540e2b8b109ac05264f45"},
+		{33, "10c48bceac6355da0cc7b2c90b058eccd88eb4304d960b0730e73b1431dd60f3"},
+		{1024, "fb57f8ab3282308c5a8df00ebb27c9d19b689f13070db34a2fc7d7ad282c497c"},
+		{1025, "b001640acb81e265ee6d8e9b4aa920ad77dcaf449f59643c0fe9c374177c5bd7"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.chunks), func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("f%d", tt.chunks))
+			if err := os.WriteFile(path, testContent(tt.chunks*CHUNK_SIZE), 0644); err != nil {
+				t.Fatal(err)
+			}
+			n := Merkelify(path)
+			if got := hex.EncodeToString(n.Hash); got != tt.root {
+				t.Errorf("root %s, want %s", got, tt.root)
+			}
+			checkBigFileShape(t, n)
+		})
+	}
+}
+
+// Roots of directories of files f00, f01... of testContent(100 * i):
+// a directory hashes as sha256(2 | entries), an entry being its name padded to 32 bytes then its hash,
+// and one of more than 16 entries is split into nested directories named .betweenus-part-NN
+func TestDirectoryRoots(t *testing.T) {
+	tests := []struct {
+		count int
+		root  string
+	}{
+		{16, "17af3e8edc2b7eb7733adc9d03c9b40a9beabe1dead5ec9b26dc05f363bc042d"},
+		{17, "837152754f2ea95e2e5ced3fb1d30188157122d3d5e9f189c234c1c00c32eaa1"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.count), func(t *testing.T) {
+			dir := t.TempDir()
+			for i := 0; i < tt.count; i++ {
+				if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%02d", i)), testContent(100*i), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n := Merkelify(dir)
+			if got := hex.EncodeToString(n.Hash); got != tt.root {
+				t.Errorf("root %s, want %s", got, tt.root)
+			}
+			checkDirShape(t, n)
+		})
+	}
+}
+
+// An entry named like the parts of a split directory is left out
+func TestSplitDirectoryNameReserved(t *testing.T) {
+	share := writeShare(t, map[string][]byte{"a": {1}, SPLIT_DIR_PREFIX + "00": {2}})
+	root := Merkelify(share)
+	if len(root.Children) != 1 || root.Children[0].Name != "a" {
+		t.Errorf("entries %v published, want only a", root.Children)
+	}
+}
+
+// The tree doesn't depend on the order in which workers finish
+func TestHashWorkersSameRoot(t *testing.T) {
+	defer func(workers int, force bool) { HashWorkers, ForceRehash = workers, force }(HashWorkers, ForceRehash)
+	ForceRehash = true // both builds hash the files, none takes the hashes of the other from the hash cache
+
+	files := map[string][]byte{
+		"big":                     testContent(33*MAX_CHILDREN*CHUNK_SIZE + 5),
+		SPLIT_DIR_PREFIX + "00":   nil, // left out
+		"top/empty/":              nil,
+		"top/" + SPLIT_DIR_PREFIX: nil, // left out
+	}
+	for d := 0; d < 3; d++ {
+		for i := 0; i < 20; i++ {
+			files[fmt.Sprintf("top/d%d/f%02d", d, i)] = testContent(i * 7919)
+			files[fmt.Sprintf("top/d%d/nested/g%02d", d, i)] = testContent(i * 4099)
+		}
+	}
+	share := writeShare(t, files)
+
+	var roots [][]byte
+	for _, workers := range []int{1, 8} {
+		HashWorkers = workers
+		root := Merkelify(share)
+		checkDirShape(t, root)
+		roots = append(roots, root.Hash)
+	}
+	if !bytes.Equal(roots[0], roots[1]) {
+		t.Errorf("root %x with 1 worker, %x with 8", roots[0], roots[1])
+	}
+}
@@ -0,0 +1,322 @@
+package moduls
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Message is one UDP datagram of the protocol:
+// Id (4 bytes) | Type (1 byte) | Length (2 bytes) | Body (Length bytes) | Signature (optional, 64 bytes)
+// The whole wire format lives here: every send and receive path goes through MarshalBinary / UnmarshalBinary.
+type Message struct {
+	Id        uint32
+	Type      byte
+	Body      []byte
+	Signature []byte // nil if the message is not signed
+}
+
+// Encode message to binary, checking that the body has the shape required by its type
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if err := checkBody(m.Type, m.Body); err != nil {
+		return nil, err
+	}
+	if len(m.Signature) != 0 && len(m.Signature) != SIGN_SIZE {
+		return nil, &MessageError{m.Type, ErrBadSignature, fmt.Sprintf("signature of %d bytes", len(m.Signature))}
+	}
+	if HEADER_SIZE+len(m.Body)+len(m.Signature) > DATAGRAM_SIZE {
+		return nil, &MessageError{m.Type, ErrTooLong, fmt.Sprintf("body of %d bytes", len(m.Body))}
+	}
+
+	data := make([]byte, HEADER_SIZE+len(m.Body)+len(m.Signature))
+	binary.BigEndian.PutUint32(data[:ID_SIZE], m.Id)
+	data[ID_SIZE] = m.Type
+	binary.BigEndian.PutUint16(data[ID_SIZE+TYPE_SIZE:HEADER_SIZE], uint16(len(m.Body)))
+	copy(data[HEADER_SIZE:], m.Body)
+	copy(data[HEADER_SIZE+len(m.Body):], m.Signature)
+	return data, nil
+}
+
+// Decode message from binary (exactly one datagram).
+// The bytes following the body are taken as the signature, so there must be either none or SIGN_SIZE of them.
+// Body and Signature are copies, so the buffer can be reused after the call.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	if len(data) < HEADER_SIZE {
+		return &MessageError{NO_OP, ErrShortMessage, fmt.Sprintf("%d bytes", len(data))}
+	}
+	typeMes := data[ID_SIZE]
+	length := int(binary.BigEndian.Uint16(data[ID_SIZE+TYPE_SIZE : HEADER_SIZE]))
+
+	if HEADER_SIZE+length > len(data) {
+		return &MessageError{typeMes, ErrLengthMismatch, fmt.Sprintf("length %d, but only %d bytes of body", length, len(data)-HEADER_SIZE)}
+	}
+	rest := len(data) - HEADER_SIZE - length
+	if rest != 0 && rest != SIGN_SIZE {
+		return &MessageError{typeMes, ErrLengthMismatch, fmt.Sprintf("length %d, but %d bytes after body", length, rest)}
+	}
+
+	body := data[HEADER_SIZE : HEADER_SIZE+length]
+	if err := checkBody(typeMes, body); err != nil {
+		return err
+	}
+
+	m.Id = binary.BigEndian.Uint32(data[:ID_SIZE])
+	m.Type = typeMes
+	m.Body = append([]byte(nil), body...)
+	m.Signature = nil
+	if rest == SIGN_SIZE {
+		m.Signature = append([]byte(nil), data[HEADER_SIZE+length:]...)
+	}
+	return nil
+}
+
+// Check that the body has the shape required by the type of message.
+// Unknown types are accepted as is: the protocol says they must be ignored, not rejected.
+func checkBody(typeMes byte, body []byte) error {
+	l := len(body)
+	switch typeMes {
+	case HELLO, HELLO_REPLY:
+		if l < EXTENSIONS_SIZE+1 {
+			return &MessageError{typeMes, ErrBadBody, fmt.Sprintf("%d bytes, need extensions and a name", l)}
+		}
+	case PUBLIC_KEY, PUBLIC_KEY_REPLY:
+		if l != 0 && l != KEY_SIZE {
+			return &MessageError{typeMes, ErrBadBody, fmt.Sprintf("key of %d bytes", l)}
+		}
+	case ROOT, ROOT_REPLY, GET_DATUM, NO_DATUM:
+		if l != HASH_SIZE {
+			return &MessageError{typeMes, ErrBadBody, fmt.Sprintf("hash of %d bytes", l)}
+		}
+	case DATUM:
+		if l < HASH_SIZE+1 || l > HASH_SIZE+MAX_VALUE_SIZE {
+			return &MessageError{typeMes, ErrBadBody, fmt.Sprintf("hash and value of %d bytes", l)}
+		}
+	case SESSION_KEY, SESSION_KEY_REPLY:
+		if l != KEY_SIZE {
+			return &MessageError{typeMes, ErrBadBody, fmt.Sprintf("ephemeral key of %d bytes", l)}
+		}
+	case SEALED, SEALED_REPLY:
+		if l < NONCE_SIZE+TYPE_SIZE+TAG_SIZE {
+			return &MessageError{typeMes, ErrBadBody, fmt.Sprintf("%d bytes, need nonce, type and tag", l)}
+		}
+	case NAT_TRAVERSAL_REQUEST, NAT_TRAVERSAL:
+		if l != IPV4_ADDR_SIZE && l != IPV6_ADDR_SIZE {
+			return &MessageError{typeMes, ErrBadBody, fmt.Sprintf("address of %d bytes", l)}
+		}
+	}
+	return nil
+}
+
+// ==========================   Constructors ========================== //
+
+// Hello or HelloReply: extensions (4 bytes) + name of peer
+func NewHelloMessage(id uint32, typeMes byte, extensions uint32, myPeer string) *Message {
+	body := make([]byte, EXTENSIONS_SIZE+len(myPeer))
+	binary.BigEndian.PutUint32(body[:EXTENSIONS_SIZE], extensions)
+	copy(body[EXTENSIONS_SIZE:], myPeer)
+	return &Message{Id: id, Type: typeMes, Body: body}
+}
+
+// PublicKey or PublicKeyReply: key of 64 bytes, or nil if we have no key
+func NewPublicKeyMessage(id uint32, typeMes byte, key []byte) *Message {
+	return &Message{Id: id, Type: typeMes, Body: append([]byte(nil), key...)}
+}
+
+// Root, RootReply, GetDatum or NoDatum: a single hash
+func NewHashMessage(id uint32, typeMes byte, hash []byte) *Message {
+	return &Message{Id: id, Type: typeMes, Body: append([]byte(nil), hash...)}
+}
+
+// Datum: hash (32 bytes) + value
+func NewDatumMessage(id uint32, hash []byte, value []byte) *Message {
+	body := make([]byte, HASH_SIZE+len(value))
+	copy(body[:HASH_SIZE], hash)
+	copy(body[HASH_SIZE:], value)
+	return &Message{Id: id, Type: DATUM, Body: body}
+}
+
+// NatTraversalRequest or NatTraversal: IP (4 or 16 bytes) + port (2 bytes)
+func NewNatTraversalMessage(id uint32, typeMes byte, addr *net.UDPAddr) *Message {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	body := make([]byte, len(ip)+2)
+	copy(body, ip)
+	binary.BigEndian.PutUint16(body[len(ip):], uint16(addr.Port))
+	return &Message{Id: id, Type: typeMes, Body: body}
+}
+
+// ==========================   Accessors ========================== //
+
+// Extensions and name of peer of Hello or HelloReply
+func (m *Message) Hello() (extensions uint32, name string, err error) {
+	if err := m.expectType(HELLO, HELLO_REPLY); err != nil {
+		return 0, "", err
+	}
+	return binary.BigEndian.Uint32(m.Body[:EXTENSIONS_SIZE]), string(m.Body[EXTENSIONS_SIZE:]), nil
+}
+
+// Hash carried by Root, RootReply, GetDatum or NoDatum
+func (m *Message) Hash() ([]byte, error) {
+	if err := m.expectType(ROOT, ROOT_REPLY, GET_DATUM, NO_DATUM); err != nil {
+		return nil, err
+	}
+	return m.Body, nil
+}
+
+// Hash and value of Datum
+func (m *Message) Datum() (hash []byte, value []byte, err error) {
+	if err := m.expectType(DATUM); err != nil {
+		return nil, nil, err
+	}
+	return m.Body[:HASH_SIZE], m.Body[HASH_SIZE:], nil
+}
+
+// Address carried by NatTraversalRequest or NatTraversal
+func (m *Message) Address() (*net.UDPAddr, error) {
+	if err := m.expectType(NAT_TRAVERSAL_REQUEST, NAT_TRAVERSAL); err != nil {
+		return nil, err
+	}
+	l := len(m.Body) - 2
+	return &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), m.Body[:l]...)),
+		Port: int(binary.BigEndian.Uint16(m.Body[l:])),
+	}, nil
+}
+
+func (m *Message) expectType(types ...byte) error {
+	if err := checkBody(m.Type, m.Body); err != nil {
+		return err
+	}
+	for _, t := range types {
+		if m.Type == t {
+			return nil
+		}
+	}
+	return &MessageError{m.Type, ErrUnexpectedType, ""}
+}
+
+// Human readable name of type of message, for logs
+func TypeName(typeMes byte) string {
+	switch typeMes {
+	case NO_OP:
+		return "NO_OP"
+	case ERROR:
+		return "ERROR"
+	case ERROR_REPLY:
+		return "ERROR_REPLY"
+	case HELLO:
+		return "HELLO"
+	case HELLO_REPLY:
+		return "HELLO_REPLY"
+	case PUBLIC_KEY:
+		return "PUBLIC_KEY"
+	case PUBLIC_KEY_REPLY:
+		return "PUBLIC_KEY_REPLY"
+	case ROOT:
+		return "ROOT"
+	case ROOT_REPLY:
+		return "ROOT_REPLY"
+	case GET_DATUM:
+		return "GET_DATUM"
+	case DATUM:
+		return "DATUM"
+	case NO_DATUM:
+		return "NO_DATUM"
+	case NAT_TRAVERSAL_REQUEST:
+		return "NAT_TRAVERSAL_REQUEST"
+	case NAT_TRAVERSAL:
+		return "NAT_TRAVERSAL"
+	case SESSION_KEY:
+		return "SESSION_KEY"
+	case SESSION_KEY_REPLY:
+		return "SESSION_KEY_REPLY"
+	case SEALED:
+		return "SEALED"
+	case SEALED_REPLY:
+		return "SEALED_REPLY"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", typeMes)
+	}
+}
+
+// ==========================   UDP I/O ========================== //
+
+// Send message through UDP, signed if its type must be (see signMessage),
+// inside a Sealed message if a session is open with the peer (see sealMessage).
+// remoteAddr must be nil for connected sockets (created with DialUDP)
+func writeMessage(conn *net.UDPConn, remoteAddr *net.UDPAddr, m *Message) error {
+	if sealed := sealMessage(peerAddr(conn, remoteAddr), m); sealed != nil {
+		m = sealed
+	}
+	signMessage(m)
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if remoteAddr == nil {
+		_, err = conn.Write(data)
+	} else {
+		_, err = conn.WriteToUDP(data, remoteAddr)
+	}
+	return err
+}
+
+// Receive one datagram, decode it, open it if it is Sealed and check its signature.
+// Returns the network error as is (so timeouts can be detected),
+// or a *MessageError if the datagram is malformed, can't be opened or its signature is refused (see verifyMessage)
+func readMessage(conn *net.UDPConn, buf []byte) (*Message, *net.UDPAddr, error) {
+	l, remoteAddr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, remoteAddr, err
+	}
+	var m Message
+	if err := m.UnmarshalBinary(buf[:l]); err != nil {
+		return nil, remoteAddr, err
+	}
+	opened, err := openMessage(&m, remoteAddr)
+	if err != nil {
+		return nil, remoteAddr, err
+	}
+	if err := verifyMessage(opened, remoteAddr); err != nil {
+		return nil, remoteAddr, err
+	}
+	return opened, remoteAddr, nil
+}
+
+// Receive the next message coming from remoteAddr (any address if nil), dropping the others
+func readFrom(conn *net.UDPConn, remoteAddr *net.UDPAddr, buf []byte) (*Message, error) {
+	for {
+		m, from, err := readMessage(conn, buf)
+		if _, ok := err.(*MessageError); ok || (err == nil && !sameAddr(remoteAddr, from)) {
+			continue
+		}
+		return m, err
+	}
+}
+
+// Does a datagram from "from" come from addr (always true if addr is nil, for connected sockets)
+func sameAddr(addr *net.UDPAddr, from *net.UDPAddr) bool {
+	if addr == nil {
+		return true
+	}
+	return from != nil && addr.Port == from.Port && addr.IP.Equal(from.IP)
+}
+
+// Check type and id of received message
+// Return:
+// 2 if type does not match expected type
+// 3 if id does not match expected id
+// 0 if all is ok
+func checkIncoming(m *Message, typeExp byte, idExp uint32) int {
+	if m.Type != typeExp {
+		UnexpectedMessage(fmt.Sprintf("Not a %s was recieved, but %s", TypeName(typeExp), TypeName(m.Type)))
+		return 2
+	}
+	if m.Id != idExp {
+		PrintError(fmt.Sprintf("Id of request %d != id of response %d", idExp, m.Id))
+		return 3
+	}
+	return 0
+}
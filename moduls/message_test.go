@@ -0,0 +1,120 @@
+package moduls
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCheckBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		typeMes byte
+		size    int
+		err     error // nil if the body is accepted
+	}{
+		{"hello with name", HELLO, EXTENSIONS_SIZE + 1, nil},
+		{"hello without name", HELLO, EXTENSIONS_SIZE, ErrBadBody},
+		{"hello reply empty", HELLO_REPLY, 0, ErrBadBody},
+		{"public key", PUBLIC_KEY, KEY_SIZE, nil},
+		{"no public key", PUBLIC_KEY_REPLY, 0, nil},
+		{"short public key", PUBLIC_KEY_REPLY, KEY_SIZE - 1, ErrBadBody},
+		{"root", ROOT, HASH_SIZE, nil},
+		{"long root reply", ROOT_REPLY, HASH_SIZE + 1, ErrBadBody},
+		{"get datum", GET_DATUM, HASH_SIZE, nil},
+		{"short no datum", NO_DATUM, HASH_SIZE - 1, ErrBadBody},
+		{"datum of one byte", DATUM, HASH_SIZE + 1, nil},
+		{"datum of a full chunk", DATUM, HASH_SIZE + MAX_VALUE_SIZE, nil},
+		{"datum without value", DATUM, HASH_SIZE, ErrBadBody},
+		{"datum too long", DATUM, HASH_SIZE + MAX_VALUE_SIZE + 1, ErrBadBody},
+		{"session key", SESSION_KEY, KEY_SIZE, nil},
+		{"short session key reply", SESSION_KEY_REPLY, KEY_SIZE - 1, ErrBadBody},
+		{"sealed", SEALED, NONCE_SIZE + TYPE_SIZE + TAG_SIZE, nil},
+		{"sealed reply without tag", SEALED_REPLY, NONCE_SIZE + TYPE_SIZE, ErrBadBody},
+		{"nat traversal ipv4", NAT_TRAVERSAL, IPV4_ADDR_SIZE, nil},
+		{"nat traversal request ipv6", NAT_TRAVERSAL_REQUEST, IPV6_ADDR_SIZE, nil},
+		{"nat traversal of 5 bytes", NAT_TRAVERSAL, 5, ErrBadBody},
+		{"unknown type", 42, 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkBody(tt.typeMes, make([]byte, tt.size))
+			if !errors.Is(err, tt.err) {
+				t.Errorf("checkBody(%s, %d bytes) = %v, want %v", TypeName(tt.typeMes), tt.size, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	signature := bytes.Repeat([]byte{0xAB}, SIGN_SIZE)
+	tests := []struct {
+		name string
+		m    *Message
+	}{
+		{"hello", NewHelloMessage(1, HELLO, EXTENSION_ENCRYPTION, "peer")},
+		{"signed hello reply", &Message{Id: 2, Type: HELLO_REPLY, Body: []byte{0, 0, 0, 0, 'p'}, Signature: signature}},
+		{"empty public key", NewPublicKeyMessage(3, PUBLIC_KEY_REPLY, nil)},
+		{"get datum", NewHashMessage(0xFFFFFFFF, GET_DATUM, bytes.Repeat([]byte{7}, HASH_SIZE))},
+		{"datum", NewDatumMessage(5, bytes.Repeat([]byte{1}, HASH_SIZE), append([]byte{CHUNK}, make([]byte, CHUNK_SIZE)...))},
+		{"nat traversal", NewNatTraversalMessage(6, NAT_TRAVERSAL, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8443})},
+		{"unknown type", &Message{Id: 7, Type: 200, Body: []byte{1, 2, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.m.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Message
+			if err := got.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if got.Id != tt.m.Id || got.Type != tt.m.Type || !bytes.Equal(got.Body, tt.m.Body) || !bytes.Equal(got.Signature, tt.m.Signature) {
+				t.Errorf("decoded %+v, sent %+v", got, *tt.m)
+			}
+		})
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	hello := []byte{0, 0, 0, 1, HELLO, 0, 5, 0, 0, 0, 0, 'p'}
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"shorter than header", []byte{0, 0, 0, 1, HELLO, 0}, ErrShortMessage},
+		{"length past the end", append(hello[:HEADER_SIZE:HEADER_SIZE], 0, 0, 0), ErrLengthMismatch},
+		{"bytes after body that are no signature", append(append([]byte(nil), hello...), 1, 2, 3), ErrLengthMismatch},
+		{"body of the wrong shape", []byte{0, 0, 0, 1, ROOT, 0, 1, 0}, ErrBadBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Message
+			if err := m.UnmarshalBinary(tt.data); !errors.Is(err, tt.err) {
+				t.Errorf("UnmarshalBinary = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMarshalRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Message
+		err  error
+	}{
+		{"signature of the wrong size", &Message{Type: ROOT, Body: make([]byte, HASH_SIZE), Signature: make([]byte, 10)}, ErrBadSignature},
+		{"body of the wrong shape", &Message{Type: GET_DATUM, Body: make([]byte, 3)}, ErrBadBody},
+		{"too long for a datagram", &Message{Type: 200, Body: make([]byte, DATAGRAM_SIZE)}, ErrTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.m.MarshalBinary(); !errors.Is(err, tt.err) {
+				t.Errorf("MarshalBinary = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
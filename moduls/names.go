@@ -0,0 +1,134 @@
+package moduls
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// File of the state directory listing the entries published under another name: "original path <TAB> published path"
+const NAME_MAP_FILE = "published-names.txt"
+
+// Longest extension kept when a name is shortened
+const MAX_KEPT_EXTENSION = 8
+
+// Why a name can't be published at all, "" if it can.
+// Peers refuse a whole directory with one such entry (see verifyName).
+func nameProblem(name string) string {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return "name not allowed"
+	case strings.ContainsRune(name, 0):
+		return "name contains NUL"
+	case strings.ContainsRune(name, '/'):
+		return "name contains '/'"
+	case !utf8.ValidString(name):
+		return "name is not UTF-8"
+	}
+	return ""
+}
+
+// Give names that don't fit in NAME_SIZE bytes a shorter one, unique in their directory.
+// Names that fit are kept as they are. The others, in directory order, get their first free name among:
+// the name cut to fit, then the name cut to fit with "~1", "~2"... before its extension.
+// Names are only cut between runes, so the result is the same for the same directory, and always valid UTF-8.
+// Names are taken from the path of the entries: nodes reused from a previous tree are named again.
+func publishNames(entries []Node) {
+	taken := map[string]bool{}
+	for i := range entries {
+		entries[i].Name = gopath.Base(entries[i].Path)
+		if len(entries[i].Name) <= NAME_SIZE {
+			taken[entries[i].Name] = true
+		}
+	}
+	for i := range entries {
+		if len(entries[i].Name) <= NAME_SIZE {
+			continue
+		}
+		for n := 0; ; n++ {
+			suffix := ""
+			if n > 0 {
+				suffix = fmt.Sprintf("~%d", n)
+			}
+			name := shortenName(entries[i].Name, suffix)
+			if !taken[name] {
+				taken[name] = true
+				entries[i].Name = name
+				break
+			}
+		}
+	}
+}
+
+// Cut name on a rune boundary so that with suffix it fits in NAME_SIZE bytes, keeping a short extension
+func shortenName(name string, suffix string) string {
+	ext := gopath.Ext(name)
+	if ext == name || len(ext) > MAX_KEPT_EXTENSION {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+
+	budget := NAME_SIZE - len(ext) - len(suffix)
+	for len(stem) > budget {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	return stem + suffix + ext
+}
+
+// Entries of tree published under another name than theirs on disk
+// Return: lines "original path <TAB> published path", both relative to the share
+func renamedEntries(root Node) []string {
+	var lines []string
+	var walk func(n Node, original string, published string)
+	walk = func(n Node, original string, published string) {
+		if n.NodeType != DIRECTORY {
+			return
+		}
+		for _, child := range flattenDirectory(n.Children) {
+			o := original + "/" + gopath.Base(child.Path)
+			p := published + "/" + child.Name
+			if child.Name != gopath.Base(child.Path) {
+				lines = append(lines, o+"\t"+p)
+			}
+			walk(child, o, p)
+		}
+	}
+	walk(root, "", "")
+	return lines
+}
+
+// Write the entries of tree published under another name in the state directory of the share, if they changed
+func saveNameMap(root Node) {
+	dir := ShareStateDir(root.Path)
+	if dir == "" {
+		return
+	}
+	lines := renamedEntries(root)
+	path := filepath.Join(dir, NAME_MAP_FILE)
+	if len(lines) == 0 {
+		os.Remove(path)
+		return
+	}
+
+	var content bytes.Buffer
+	for _, line := range lines {
+		fmt.Fprintln(&content, line)
+	}
+	if previous, err := os.ReadFile(path); err == nil && bytes.Equal(previous, content.Bytes()) {
+		return
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		HandlePanicError(err, "Name map: mkdir")
+		return
+	}
+	if err := os.WriteFile(path, content.Bytes(), 0600); err != nil {
+		HandlePanicError(err, "Name map: write")
+		return
+	}
+	fmt.Printf("Share %s: %d entries published under a shorter name, see %s\n", root.Path, len(lines), path)
+}
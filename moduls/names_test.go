@@ -0,0 +1,93 @@
+package moduls
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestShortenName(t *testing.T) {
+	a := strings.Repeat
+	tests := []struct {
+		name   string
+		suffix string
+		want   string
+	}{
+		{"short.txt", "", "short.txt"},
+		{a("a", 40) + ".txt", "", a("a", 28) + ".txt"},
+		{a("a", 40) + ".txt", "~1", a("a", 26) + "~1.txt"},
+		{a("a", 40) + ".txt", "~10", a("a", 25) + "~10.txt"},
+		{a("é", 20), "", a("é", 16)},
+		{"a" + a("é", 20), "", "a" + a("é", 15)}, // a rune is never cut
+		{a("😀", 9), "", a("😀", 8)},
+		{a("😀", 9), "~1", a("😀", 7) + "~1"},
+		{a("x", 30) + ".verylongextension", "", a("x", 30) + ".v"}, // extension too long to keep
+		{"." + a("b", 40), "", "." + a("b", 31)},                   // dot file: no extension
+		{a("c", 30) + ".tar.gz", "~1", a("c", 27) + "~1.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got := shortenName(tt.name, tt.suffix)
+			if got != tt.want {
+				t.Errorf("shortenName(%q, %q) = %q, want %q", tt.name, tt.suffix, got, tt.want)
+			}
+			if len(got) > NAME_SIZE || !utf8.ValidString(got) {
+				t.Errorf("%q: %d bytes, valid UTF-8 %v", got, len(got), utf8.ValidString(got))
+			}
+		})
+	}
+}
+
+func TestPublishNames(t *testing.T) {
+	a := strings.Repeat
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{"names that fit are kept", []string{"a", "b.txt", a("c", 32)}, []string{"a", "b.txt", a("c", 32)}},
+		{"long names cut", []string{a("a", 40) + ".txt", "b"}, []string{a("a", 28) + ".txt", "b"}},
+		{"same cut names numbered", []string{a("a", 40) + ".txt", a("a", 41) + ".txt"},
+			[]string{a("a", 28) + ".txt", a("a", 26) + "~1.txt"}},
+		{"name that fits keeps its name", []string{a("a", 40) + ".txt", a("a", 41) + ".txt", a("a", 28) + ".txt"},
+			[]string{a("a", 26) + "~1.txt", a("a", 26) + "~2.txt", a("a", 28) + ".txt"}},
+		{"numbered name taken by a file", []string{a("a", 40) + ".txt", a("a", 41) + ".txt", a("a", 26) + "~1.txt"},
+			[]string{a("a", 28) + ".txt", a("a", 26) + "~2.txt", a("a", 26) + "~1.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := make([]Node, len(tt.files))
+			for i, f := range tt.files {
+				entries[i] = Node{Name: "stale", Path: "/share/dir/" + f}
+			}
+			publishNames(entries)
+			for i, n := range entries {
+				if n.Name != tt.want[i] {
+					t.Errorf("%q published as %q, want %q", tt.files[i], n.Name, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNameProblem(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"file.txt", true},
+		{"été", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"...", true},
+		{"a\x00b", false},
+		{"a/b", false},
+		{"\xff", false},
+	}
+	for _, tt := range tests {
+		if got := nameProblem(tt.name) == ""; got != tt.ok {
+			t.Errorf("nameProblem(%q) = %q", tt.name, nameProblem(tt.name))
+		}
+	}
+}
@@ -1,32 +1,30 @@
 package moduls
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
-	"strings"
 	"time"
 )
 
-func NatTraversalServer(message []byte, i int) *net.UDPConn {
-	len := binary.BigEndian.Uint16(message[POS_LENGTH:(POS_LENGTH + LENGTH_SIZE)])
-	stAddrPeer := string(message[POS_VALUE:(POS_VALUE + len)])
-	fmt.Printf("Address of peer : %s\n", stAddrPeer)
-
-	//Natalia: why port is hardcoded???
-	myAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", (8443+i)))
-	HandleFatalError(err, "ResolveUDPAddr failure")
-
-	peerAddr, err := net.ResolveUDPAddr("udp", stAddrPeer)
-	HandleFatalError(err, "ResolveUDPAddr failure")
-
-	conn, err := net.DialUDP("udp", myAddr, peerAddr)
-	HandleFatalError(err, "DialUDP failure")
+// Reply to NatTraversal sent by the server: greet the peer whose address it carries,
+// so that our NAT lets its datagrams through
+// Return: status like ReplyToIncoming
+func NatTraversalServer(conn *net.UDPConn, m *Message, myPeer string) int {
+	peerAddr, err := m.Address()
+	if err != nil {
+		HandlePanicError(err, "NatTraversalServer")
+		return 400
+	}
+	fmt.Printf("Address of peer : %s\n", peerAddr)
 
-	return conn
+	err = writeMessage(conn, peerAddr, NewHelloMessage(messCounter, HELLO, helloExtensions(), myPeer))
+	messCounter++
+	if err != nil {
+		HandleFatalError(err, "NatTraversalServer: Write to UDP Hello failure")
+		return 404
+	}
+	return 200
 }
 
 // NAT bypass function:
@@ -48,12 +46,12 @@ func NatTraversal(tcpClient *http.Client, conn *net.UDPConn, connPeer *net.UDPCo
 	bufRes := make([]byte, DATAGRAM_SIZE)
 
 	for count <= maxNbAtts {
-		_, err := sendHello(connPeer, myPeer)
+		_, err := sendHello(connPeer, nil, myPeer)
 		messCounter++
 		count++
 
 		if err != nil {
-			time.Sleep(1 * TIMEOUT)
+			time.Sleep(PeerRtt(connPeer.RemoteAddr()).Timeout())
 			continue
 		} else {
 			break
@@ -67,90 +65,82 @@ func NatTraversal(tcpClient *http.Client, conn *net.UDPConn, connPeer *net.UDPCo
 
 		addresses := PeerAddr(tcpClient, otherPeer)
 		fmt.Println(addresses)
-
-		ip := net.ParseIP(addresses[0])
-		addrSize := isIPv4(addresses[0])
-		if addrSize == -1 {
-			PrintError("NatTraversal: address neither IPv4, nor IPv6")
+		if len(addresses) == 0 {
+			PrintError("NatTraversal: peer has no address")
 			return RESULT_ERROR
 		}
 
-		buf := make([]byte, DATAGRAM_SIZE)
-
-		// send NatTraversalRequest to Server
-		buf = composeNatTravMessage(messCounter, byte(NAT_TRAVERSAL_REQUEST), ip, addrSize, 0)
-
-		_, err := conn.Write(buf)
-		messCounter++
+		peerAddr, err := net.ResolveUDPAddr("udp", addresses[0])
 		if err != nil {
-			HandleFatalError(err, "NatTraversal: Write to UDP")
+			HandleFatalError(err, "NatTraversal: address neither IPv4, nor IPv6")
 			return RESULT_ERROR
 		}
 
-		timeStart := time.Now()
+		// send NatTraversalRequest to Server and wait Hello from otherPeer,
+		// re-sending the request with the retransmission timeout of the server until TIMEOUT
+		request := NewNatTraversalMessage(messCounter, NAT_TRAVERSAL_REQUEST, peerAddr)
+		messCounter++
+		rttServer := PeerRtt(conn.RemoteAddr())
+		rttPeer := PeerRtt(connPeer.RemoteAddr())
 
-		// max 3 attempts to recieve Hello from otherPeer
-		count = 1
+		timeStart := time.Now()
+		count = 0
 		bExit := false
-		for count <= maxNbAtts {
-
-			connPeer.SetReadDeadline(time.Now().Add(TIMEOUT)) // set a timeout
-			count++
-
-			// wait Hello from otherPeer
-			all, _, err := connPeer.ReadFromUDP(bufRes)
+		var helloId uint32
+		for !bExit && time.Since(timeStart) < TIMEOUT {
+			err = writeMessage(conn, nil, request)
 			if err != nil {
-				if err != io.EOF {
-					HandleFatalError(err, "NatTraversal: ReadFromUDP")
-					continue
-				}
-			}
-			rezCheck := CheckUDPIncomingPacket(bufRes, all, HELLO, "HELLO")
-			switch rezCheck {
-			case 0:
-				bExit = true
-			case 1: // exit from function
-				messCounter++
-				PrintError("NatTraversal: The lenght of HELLO recieved != expected one\n")
+				HandleFatalError(err, "NatTraversal: Write to UDP")
 				return RESULT_ERROR
-
-			case 2: // reject and try to pull out the next response until TIMEOUT
-				timeNow := time.Now()
-
-				// if TIMEOUT -> exit from function to start all over again
-				if timeStart.Sub(timeNow) >= TIMEOUT {
-					messCounter++
-					PrintError("NatTraversal: Timeout reception of HELLO")
-					return RESULT_ERROR
-				} else {
-					continue
-				}
 			}
+			count++
 
-			if bExit {
-				break
+			// Hello of otherPeer makes one trip through the server and one from the peer
+			armed := rttServer.Timeout()
+			waitUntil := time.Now().Add(armed + rttPeer.Timeout())
+			if waitUntil.After(timeStart.Add(TIMEOUT)) {
+				waitUntil = timeStart.Add(TIMEOUT)
+			}
+			connPeer.SetReadDeadline(waitUntil)
+
+			for {
+				// wait Hello from otherPeer
+				m, _, err := readMessage(connPeer, bufRes)
+				if err != nil {
+					if _, ok := err.(*MessageError); ok { // drop and wait the next one
+						HandleFatalError(err, "NatTraversal: malformed message")
+						continue
+					}
+					if e, ok := err.(net.Error); !ok || !e.Timeout() {
+						HandleFatalError(err, "NatTraversal: ReadFromUDP")
+					}
+					rttServer.Backoff(armed)
+					break
+				}
+				// reject anything else and try to pull out the next message
+				if checkIncoming(m, HELLO, m.Id) == 0 {
+					bExit = true
+					helloId = m.Id
+					break
+				}
 			}
 		}
-		messCounter++
-		fmt.Printf("%d attempts to recieve Hello from peer { %s } was made\n", count-1, otherPeer)
+		if !bExit {
+			PrintError("NatTraversal: Timeout reception of HELLO")
+		}
+		fmt.Printf("%d attempts to recieve Hello from peer { %s } was made\n", count, otherPeer)
 
 		if bExit {
 			// send HelloReply to otherPeer
-			buf = composeHandChakeMessage(messCounter, byte(HELLO_REPLY), myPeer, 0, 0)
-			_, err = connPeer.Write(buf)
-			messCounter++
+			err = writeMessage(connPeer, nil, NewHelloMessage(helloId, HELLO_REPLY, helloExtensions(), myPeer))
 			if err != nil {
 				HandleFatalError(err, "NatTraversal: Write to UDP HelloReply failure")
 				return RESULT_ERROR
 			}
 
-			// send Hello to otherPeer
-			buf = composeHandChakeMessage(messCounter, byte(HELLO), myPeer, 0, 0)
-			_, err = connPeer.Write(buf)
-			messCounter++
-			if err != nil {
-				HandleFatalError(err, "NatTraversal: Write to UDP Hello failure")
-				return RESULT_ERROR
+			// greet otherPeer now that its datagrams get through, opening the encrypted session if we both want one
+			if _, err := sendHello(connPeer, nil, myPeer); err != nil {
+				UnexpectedMessage(fmt.Sprintf("NatTraversal: %v", err))
 			}
 			messCounter++
 			return RESULT_OK
@@ -161,47 +151,3 @@ func NatTraversal(tcpClient *http.Client, conn *net.UDPConn, connPeer *net.UDPCo
 		return RESULT_OK
 	}
 }
-
-// Composes UDP message to send NatTravessal request and converts it to binary
-func composeNatTravMessage(idMes uint32, typeMes uint8, addr []byte, lenMes int, extentMes int) []byte {
-
-	var buf bytes.Buffer
-
-	i := make([]byte, 4)
-	binary.BigEndian.PutUint32(i, idMes)
-	buf.Write(i)
-
-	buf.WriteByte(typeMes)
-
-	j := make([]byte, 2)
-	binary.BigEndian.PutUint16(j, uint16(lenMes))
-	buf.Write(j)
-
-	buf.Write(addr)
-
-	k := make([]byte, 4)
-	binary.BigEndian.PutUint32(k, uint32(extentMes))
-	buf.Write(k)
-
-	return buf.Bytes()
-}
-
-// Cheque if IP adress is is IPv4 or IPv6
-// Parameter: string address
-// Return: size in byte of address
-//  6 for IPv4
-// 18 for IPv6
-// -1 else
-func isIPv4(addr string) int {
-	a := strings.Split(addr, ":")
-	ip := net.ParseIP(a[0])
-	if ip == nil {
-		PrintError("IP address is not valid\n")
-		return -1
-	}
-
-	if ip.To4() != nil {
-		return 6
-	}
-	return 18
-}
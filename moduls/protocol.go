@@ -3,29 +3,25 @@ package moduls
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 )
 
 const url = "https://jch.irif.fr:8443"
 const TIMEOUT = 5 * time.Second
+const DATUM_TIMEOUT = 30 * time.Second // give up waiting for a Datum
 const LOG_PRINT_DATA = false
 
 var messCounter uint32 = 1
 
 var isCanceled bool = true // if need to maintain connection with server
 
-var Root Node
-
 // MESSAGE TYPES
 const (
 	NO_OP                 = 0
@@ -42,6 +38,10 @@ const (
 	NO_DATUM              = 133
 	NAT_TRAVERSAL_REQUEST = 6
 	NAT_TRAVERSAL         = 7
+	SESSION_KEY           = 8
+	SESSION_KEY_REPLY     = 136
+	SEALED                = 9
+	SEALED_REPLY          = 137
 )
 
 const (
@@ -65,22 +65,22 @@ const (
 
 // SIZES (bytes, count)
 const (
-	CHUNK_SIZE    = 1024
-	DATAGRAM_SIZE = 2048 // 4 id + 1 type + 2 length + 1 node type + 1024 body + 64 singature
-	ID_SIZE       = 4
-	TYPE_SIZE     = 1
-	LENGTH_SIZE   = 2
-	HASH_SIZE     = 32
-	NAME_SIZE     = 32
-	VALUE_SIZE    = 32
-	SIGN_SIZE     = 64
-	POS_TYPE      = 4
-	POS_LENGTH    = 5
-	POS_BODY      = 7
-	POS_HASH      = 7
-	POS_VALUE     = 39
-	POS_SIGN      = 71
-	MAX_CHILDREN  = 32 // max children in the tree
+	CHUNK_SIZE      = 1024
+	DATAGRAM_SIZE   = 2048 // 4 id + 1 type + 2 length + 1 node type + 1024 body + 64 singature
+	ID_SIZE         = 4
+	TYPE_SIZE       = 1
+	LENGTH_SIZE     = 2
+	HEADER_SIZE     = ID_SIZE + TYPE_SIZE + LENGTH_SIZE
+	EXTENSIONS_SIZE = 4
+	HASH_SIZE       = 32
+	NAME_SIZE       = 32
+	VALUE_SIZE      = 32
+	SIGN_SIZE       = 64
+	KEY_SIZE        = 64
+	IPV4_ADDR_SIZE  = 6              // 4 ip + 2 port
+	IPV6_ADDR_SIZE  = 18             // 16 ip + 2 port
+	MAX_VALUE_SIZE  = 1 + CHUNK_SIZE // node type + chunk (or 32 hashes, or 16 entries)
+	MAX_CHILDREN    = 32             // max children in the tree
 )
 
 // Structure for temporary storage of data downloaded from hash (chunks, big_files or directories)
@@ -100,18 +100,20 @@ type DataObject struct {
 	SearchPath string //path to search for to be downloaded
 	HddPath    string //path to store data on HDD
 	Handle     *os.File
+	Peer       string //name of remote peer, to report bad nodes
 }
 
 // ==========================   Main functions ========================== //
 // Register on the server
 // Parameters:PublicKey
 // - conn - UDP Connection
+// - serverAddr - address of server, nil if conn is connected to it
 // - myPeer - name of my peer
 // Return: public key of Server
-func RegistrationOnServer(conn *net.UDPConn, myPeer string, root *Node) []byte {
+func RegistrationOnServer(conn *net.UDPConn, serverAddr *net.UDPAddr, myPeer string, root *Node) []byte {
 	// send Hello till reception of good HelloReply
 	for {
-		b, err := sendHello(conn, myPeer)
+		b, err := sendHello(conn, serverAddr, myPeer)
 		if err != nil {
 			HandlePanicError(err, "RegistrationOnServer")
 			return nil
@@ -125,24 +127,31 @@ func RegistrationOnServer(conn *net.UDPConn, myPeer string, root *Node) []byte {
 
 	//recieve PublicKey
 	buf := make([]byte, DATAGRAM_SIZE)
-	l, _, err := conn.ReadFromUDP(buf)
+	conn.SetReadDeadline(time.Now().Add(TIMEOUT)) // set Timeout
+	m, err := readFrom(conn, serverAddr, buf)
 	if err != nil {
-		if err != io.EOF {
-			fmt.Printf("PublicKey: ReadFromUDP error %v\n", err)
-			return nil
-		}
+		fmt.Printf("PublicKey: ReadFromUDP error %v\n", err)
+		return nil
 	}
-	if CheckTypeEquality(byte(PUBLIC_KEY), buf) == -1 {
+	if checkIncoming(m, PUBLIC_KEY, m.Id) != 0 {
 		return nil
 	}
 
-	newMessId := binary.BigEndian.Uint32(buf[:4])
+	ServerPublicKey := m.Body
 
-	ServerPublicKey := buf[7:l]
+	// what the server sends from now on is checked against its key,
+	// unless its signed HelloReply already gave the key published for its name
+	if serverAddr != nil {
+		err = setAddrKey(serverAddr, ServerPublicKey)
+	} else {
+		err = setAddrKey(conn.RemoteAddr(), ServerPublicKey)
+	}
+	if err != nil {
+		UnexpectedMessage(fmt.Sprintf("PublicKey: %v, the key of its HelloReply is kept\n", err))
+	}
 
 	// send PublicKeyReply
-	buf = composeHandChakeMessage(newMessId, byte(PUBLIC_KEY_REPLY), myPeer, 0, 0)
-	_, err = conn.Write(buf)
+	err = writeMessage(conn, serverAddr, NewPublicKeyMessage(m.Id, PUBLIC_KEY_REPLY, myPublicKey()))
 	if err != nil {
 		PanicMessage("PublicKeyReply: Write PUBLIC_KEY_REPLY to UDP failure\n")
 		return nil
@@ -152,46 +161,25 @@ func RegistrationOnServer(conn *net.UDPConn, myPeer string, root *Node) []byte {
 	conn.SetReadDeadline(time.Now().Add(TIMEOUT)) // set Timeout
 
 	// recieve Root
-	buf = make([]byte, DATAGRAM_SIZE)
-	l, _, err = conn.ReadFromUDP(buf)
+	m, err = readFrom(conn, serverAddr, buf)
 	if err != nil {
-		if err != io.EOF {
-			fmt.Printf("Root: ReadFromUDP error %v\n", err)
-			return nil
-		}
+		fmt.Printf("Root: ReadFromUDP error %v\n", err)
+		return nil
 	}
-	if CheckTypeEquality(byte(ROOT), buf) == -1 {
+	if checkIncoming(m, ROOT, m.Id) != 0 {
 		return nil
 	}
 
-	newMessId = binary.BigEndian.Uint32(buf[:4])
-
-	// send Hash("")
+	// send Hash("") if we share nothing
+	var rootHash []byte
 	if root == nil {
-		buf = composeDataSendMessage(newMessId, byte(ROOT_REPLY), HASH_SIZE, "")
-
+		emptyHash := sha256.Sum256([]byte(""))
+		rootHash = emptyHash[:]
 	} else {
-		var bytesBuffer bytes.Buffer
-		i := make([]byte, 4)
-		binary.BigEndian.PutUint32(i, newMessId)
-		bytesBuffer.Write(i)
-
-		bytesBuffer.WriteByte(byte(ROOT_REPLY))
-
-		j := make([]byte, 2)
-		binary.BigEndian.PutUint16(j, uint16(HASH_SIZE))
-		bytesBuffer.Write(j)
-
-		bytesBuffer.Write(root.Hash)
-
-		// TODO where value!!
-
-		buf = bytesBuffer.Bytes()
-
-		//Natalia: receive root reply
+		rootHash = root.Hash
 	}
 
-	_, err = conn.Write(buf)
+	err = writeMessage(conn, serverAddr, NewHashMessage(m.Id, ROOT_REPLY, rootHash))
 	if err != nil {
 		PanicMessage("PublicKeyReply: Write ROOT_REPLY to UDP failure\n")
 		return nil
@@ -202,112 +190,76 @@ func RegistrationOnServer(conn *net.UDPConn, myPeer string, root *Node) []byte {
 }
 
 // Maintain connection with server - sends messages every 30 seconds
-func MaintainConnectionServer(conn *net.UDPConn, root *Node) {
+// serverAddr is nil if conn is connected to the server
+func MaintainConnectionServer(conn *net.UDPConn, serverAddr *net.UDPAddr, root *Node) {
 	fmt.Printf("---- MaintainConnectionServer ---- \n")
 
-	buf := make([]byte, DATAGRAM_SIZE)
-
-	var bytesBuffer bytes.Buffer
-	i := make([]byte, 4)
-	binary.BigEndian.PutUint32(i, messCounter)
-	bytesBuffer.Write(i)
-
-	bytesBuffer.WriteByte(byte(ROOT))
-
-	j := make([]byte, 2)
-	binary.BigEndian.PutUint16(j, uint16(HASH_SIZE))
-	bytesBuffer.Write(j)
-
-	bytesBuffer.Write(root.Hash)
-	buf = bytesBuffer.Bytes()
-
-	_, err := conn.Write(buf)
+	// send Root, recieve RootReply
+	m, err := exchange(conn, serverAddr, NewHashMessage(messCounter, ROOT, root.Hash), TIMEOUT)
+	messCounter++
 	if err != nil {
-		PanicMessage("PublicKeyReply: Write ROOT_REPLY to UDP failure\n")
+		fmt.Printf("Root: exchange with server failed %v\n", err)
 		return
 	}
-
-	// recieve Root
-	buf = make([]byte, DATAGRAM_SIZE)
-	conn.SetReadDeadline(time.Now().Add(TIMEOUT)) // set Timeout
-	var l int
-	l, _, err = conn.ReadFromUDP(buf)
-	if err != nil {
-		if err != io.EOF {
-			fmt.Printf("Root: ReadFromUDP error %v\n", err)
-			return
-		}
-	}
-	if CheckTypeEquality(byte(ROOT_REPLY), buf) == -1 {
+	if checkIncoming(m, ROOT_REPLY, m.Id) != 0 {
 		return
 	}
 
-	fmt.Printf("---- MaintainConnectionServer: Receive ROOT_REPLY %d ---- \n", l)
-
-	messCounter++
+	fmt.Printf("---- MaintainConnectionServer: Receive ROOT_REPLY %d ---- \n", len(m.Body))
 }
 
-// Replies to getDatum requests
+// Replies to getDatum requests, from the index of the tree we share (see ShareTree)
 // params:
 // - conn : udp connection
 // - peer : address of remote peer asking for data (unsure if this will be needed or not)
-// - root : root node of our merkel tree
 // peer would be of format "ip:port"
-func SendData(conn *net.UDPConn, remoteAddr *net.UDPAddr, buffer []byte, root Node) (status int) {
-
-	hash := buffer[7:]
-	msgID := buffer[0:4]
-	node, value := getHash(root, hash)
-	length := 32
-	if value != nil {
-		length = len(value) + 1
+func SendData(conn *net.UDPConn, remoteAddr *net.UDPAddr, request *Message) (status int) {
+
+	hash, err := request.Hash()
+	if err != nil {
+		HandlePanicError(err, "SendData")
+		return 400
 	}
-	fmt.Printf("value: %v\n", value)
-
-	message := make([]byte, 4+1+2+length+HASH_SIZE)
-	if node == nil {
-		copy(message[0:4], msgID)
-		message[4] = byte(NO_DATUM)
-		binary.BigEndian.PutUint16(message[5:7], uint16(length))
-		copy(message[7:], hash)
-	} else {
-		copy(message[0:4], msgID)
-		//binary.BigEndian.PutUint32(message[0:4], msgID)
-		message[4] = byte(DATUM)
-		binary.BigEndian.PutUint16(message[5:7], uint16(length))
-		message[5] = byte(root.NodeType)
-		copy(message[8:], value)
+	var value []byte
+	if index := SharedIndex(); index != nil {
+		value, err = index.Lookup(hash)
+		HandlePanicError(err, "SendData")
 	}
 
-	fmt.Printf("message to send: %v\n", message)
-
-	// pick the right write method depending on how the client listening and handling of incoming message is done (clarified during call )
-	n, err := conn.WriteToUDP(message, remoteAddr)
+	var reply *Message
+	if value == nil {
+		reply = NewHashMessage(request.Id, NO_DATUM, hash)
+	} else {
+		if LOG_PRINT_DATA {
+			fmt.Printf("value: %v\n", value)
+		}
+		reply = NewDatumMessage(request.Id, hash, value)
+	}
 
+	// remoteAddr is nil for connected sockets
+	err = writeMessage(conn, remoteAddr, reply)
 	if err != nil {
 		HandlePanicError(err, fmt.Sprintf("[ERROR] sending message to %s: ", remoteAddr))
 		return 404
 	}
 	if LOG_PRINT_DATA {
-		st := fmt.Sprintf("[INFO] wrote %d bytes to %s \n", n, remoteAddr)
+		st := fmt.Sprintf("[INFO] wrote %s to %s \n", TypeName(reply.Type), remoteAddr)
 		DebugPrint(st)
 	}
 	// success
 	return 200
 }
 
-func sendHelloReply(conn *net.UDPConn, remoteAddr *net.UDPAddr, myPeer string, msgID []byte) (status int) {
-
-	helloReply := composeDataSendMessage(binary.BigEndian.Uint32(msgID), HELLO_REPLY, len(myPeer)+4, myPeer)
+func sendHelloReply(conn *net.UDPConn, remoteAddr *net.UDPAddr, myPeer string, msgID uint32) (status int) {
 
-	n, err := conn.WriteToUDP(helloReply, remoteAddr)
+	err := writeMessage(conn, remoteAddr, NewHelloMessage(msgID, HELLO_REPLY, helloExtensions(), myPeer))
 	if err != nil {
 		HandlePanicError(err, fmt.Sprintf("[ERROR]: failed to greet %s: ", remoteAddr))
 		return 404
 	}
 
 	if LOG_PRINT_DATA {
-		st := fmt.Sprintf("[INFO]: Greetings to %s with %d bytes\n", remoteAddr, n)
+		st := fmt.Sprintf("[INFO]: Greetings to %s\n", remoteAddr)
 		DebugPrint(st)
 	}
 
@@ -315,6 +267,24 @@ func sendHelloReply(conn *net.UDPConn, remoteAddr *net.UDPAddr, myPeer string, m
 
 }
 
+// Answer a PublicKey with the key of our identity
+func sendPublicKeyReply(conn *net.UDPConn, remoteAddr *net.UDPAddr, msgID uint32) (status int) {
+	err := writeMessage(conn, remoteAddr, NewPublicKeyMessage(msgID, PUBLIC_KEY_REPLY, myPublicKey()))
+	if err != nil {
+		HandlePanicError(err, fmt.Sprintf("[ERROR]: failed to send our key to %s: ", remoteAddr))
+		return 404
+	}
+	return 200
+}
+
+// Public key of our identity, nil if we have none
+func myPublicKey() []byte {
+	if id := MyIdentity(); id != nil {
+		return id.PublicKey()
+	}
+	return nil
+}
+
 func GetData(client *http.Client, peer string, hash string) {
 
 	addresses := PeerAddr(client, peer)
@@ -362,25 +332,49 @@ func GetData(client *http.Client, peer string, hash string) {
 }
 
 // replies to incoming udp messages depending on their type
-func ReplyToIncoming(conn *net.UDPConn, remoteAddr *net.UDPAddr, buffer []byte, root Node, myPeer string) (status int) {
+// buffer holds exactly one datagram
+func ReplyToIncoming(conn *net.UDPConn, remoteAddr *net.UDPAddr, buffer []byte, myPeer string) (status int) {
 
-	msgType := uint8(buffer[5])
-	length := binary.BigEndian.Uint16(buffer[5:7])
-	if int(length) != len(buffer[7:]) {
-		// length mismatch
+	var m Message
+	if err := m.UnmarshalBinary(buffer); err != nil {
+		// malformed datagram
+		HandlePanicError(err, fmt.Sprintf("[ERROR] message from %s", remoteAddr))
 		return 400
 	}
+	opened, err := openMessage(&m, remoteAddr)
+	if err != nil {
+		HandlePanicError(err, "[ERROR] message dropped")
+		return 401
+	}
+	if err := verifyMessage(opened, remoteAddr); err != nil {
+		HandlePanicError(err, "[ERROR] message dropped")
+		return 401
+	}
+	return replyToMessage(conn, remoteAddr, opened, myPeer)
+}
 
-	switch msgType {
-	case DATUM:
-		return SendData(conn, remoteAddr, buffer[7:], root)
+// Answer the requests conn receives from now on, read by its transaction table (see GetTransactions):
+// requests can then be sent on conn while it is served, even when it is not connected (see exchange)
+func ServeIncoming(conn *net.UDPConn, myPeer string) {
+	GetTransactions(conn).SetUnsolicited(func(m *Message, remoteAddr *net.UDPAddr) {
+		replyToMessage(conn, remoteAddr, m, myPeer)
+	})
+}
+
+// replies to request m, already opened and checked, depending on its type
+func replyToMessage(conn *net.UDPConn, remoteAddr *net.UDPAddr, m *Message, myPeer string) (status int) {
+	switch m.Type {
+	case GET_DATUM:
+		return SendData(conn, remoteAddr, m)
 	case HELLO:
-		return sendHelloReply(conn, remoteAddr, myPeer, buffer[0:4])
+		helloReceived(m, remoteAddr)
+		return sendHelloReply(conn, remoteAddr, myPeer, m.Id)
+	case SESSION_KEY:
+		return acceptSession(conn, remoteAddr, m)
+	case PUBLIC_KEY:
+		return sendPublicKeyReply(conn, remoteAddr, m.Id)
 	case NAT_TRAVERSAL:
-		var newConn *net.UDPConn
-		newConn = NatTraversalServer(buffer, 0)
-		SendData(newConn, remoteAddr, buffer[7:], root)
-		return RESULT_OK
+		return NatTraversalServer(conn, m, myPeer)
 	default:
 		// unknown request
 		return 404
@@ -482,29 +476,32 @@ func GetAllPeersAdresses(tcpClient *http.Client) {
 // - 200 if the peer is known and has announced a public key, and then the body contains the key (a	sequence of 64 bytes);
 // - 204 if the peer is known, but has not announced a public key;
 // - 404 if the peer is not known.
-// Return: key of peer
-func PeerKey(tcpClient *http.Client, peer string) []byte {
+// Return: key of peer, nil if it has none (204);
+// error if the server could not be asked, doesn't know the peer or gave a malformed key
+func PeerKey(tcpClient *http.Client, peer string) ([]byte, error) {
 	res, err := SendGetRequest(tcpClient, url+"/peers/"+peer+"/key")
-	HandlePanicError(err, "PeerKey: Get failure")
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("PeerKey: %w", err)
 	}
+	defer res.Body.Close()
 
 	switch res.StatusCode {
 	case 200:
-		key := make([]byte, 200)
-		res.Body.Read(key)
-		res.Body.Close()
-		return key
-	case 404:
-		fmt.Printf("PeerKey: Peer %s is unknown\n", peer)
-		return nil
+		key, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("PeerKey: peer %s: %w", peer, err)
+		}
+		if len(key) != KEY_SIZE {
+			return nil, fmt.Errorf("PeerKey: peer %s has a key of %d bytes", peer, len(key))
+		}
+		return key, nil
 	case 204:
 		fmt.Printf("PeerKey: Peer %s is known, but has not announced public key\n", peer)
-		return nil
+		return nil, nil
+	case 404:
+		return nil, fmt.Errorf("PeerKey: peer %s is unknown", peer)
 	default:
-		fmt.Printf("PeerKey: Unexpected StatusCode %d for peer %s \n", res.StatusCode, peer)
-		return nil
+		return nil, fmt.Errorf("PeerKey: unexpected StatusCode %d for peer %s", res.StatusCode, peer)
 	}
 }
 
@@ -541,301 +538,99 @@ func PeerRoot(tcpClient *http.Client, peer string) []byte {
 
 // ==========================   Auxiliary UDP functions ========================== //
 
-// Compose UDP handshake message (with a peer or server) and convert it to binary
-func composeHandChakeMessage(idMes uint32, typeMes uint8, myPeer string, lenMes int, extentMes int) []byte {
-
-	var buf bytes.Buffer
-
-	i := make([]byte, 4)
-	binary.BigEndian.PutUint32(i, idMes)
-	buf.Write(i)
-
-	buf.WriteByte(typeMes)
-
-	j := make([]byte, 2)
-	binary.BigEndian.PutUint16(j, uint16(lenMes))
-	buf.Write(j)
-
-	k := make([]byte, 4)
-	binary.BigEndian.PutUint32(k, uint32(extentMes))
-	buf.Write(k)
+// Send "Hello" & Recieve "HelloReply", then open an encrypted session if both sides want one (see EncryptSessions)
+// Hello is re-sent with the retransmission timeout of the peer until TIMEOUT
+// remoteAddr is nil if conn is connected to the peer
+func sendHello(conn *net.UDPConn, remoteAddr *net.UDPAddr, myPeer string) (bool, error) {
 
-	buf.WriteString(myPeer)
-	//fmt.Printf("my bin message : %v\n\n", buf.Bytes()) // for debug
-
-	return buf.Bytes()
-}
-
-// Compose UDP message GetDatum and convert it to binary
-func composeGetDatumMessage(idMes uint32, typeMes uint8, myPeer string, lenMes int, hash []byte, extentMes int) []byte {
-
-	var buf bytes.Buffer
-
-	i := make([]byte, 4)
-	binary.BigEndian.PutUint32(i, idMes)
-	buf.Write(i)
-
-	buf.WriteByte(typeMes)
-
-	j := make([]byte, 2)
-	binary.BigEndian.PutUint16(j, uint16(lenMes))
-	buf.Write(j)
-
-	buf.Write(hash)
-
-	k := make([]byte, 4)
-	binary.BigEndian.PutUint32(k, uint32(extentMes))
-	buf.Write(k)
-
-	buf.WriteString(myPeer)
-	//fmt.Printf("my bin message : %v\n\n", buf.Bytes()) // for debug
-
-	return buf.Bytes()
-}
-
-// Composes UDP message to send data and converts it to binary
-func composeDataSendMessage(idMes uint32, typeMes uint8, lenMes int, valueMes string) []byte {
-
-	var buf bytes.Buffer
-
-	i := make([]byte, 4)
-	binary.BigEndian.PutUint32(i, idMes)
-	buf.Write(i)
-
-	buf.WriteByte(typeMes)
-
-	j := make([]byte, 2)
-	binary.BigEndian.PutUint16(j, uint16(lenMes))
-	buf.Write(j)
-
-	hash := sha256.Sum256([]byte(valueMes))
-	buf.Write(hash[:])
-
-	buf.WriteString(valueMes)
-	//fmt.Printf("my bin message : %v\n\n", buf.Bytes()) // for debug
-
-	return buf.Bytes()
-}
-
-// Send "Hello" & Recieve "HelloReply"
-func sendHello(conn *net.UDPConn, myPeer string) (bool, error) {
-
-	// send HELLO
-	buf := composeHandChakeMessage(messCounter, byte(HELLO), myPeer, len(myPeer)+4, 0)
-	_, err := conn.Write(buf)
+	m, err := exchange(conn, remoteAddr, NewHelloMessage(messCounter, HELLO, helloExtensions(), myPeer), TIMEOUT)
+	messCounter++
+	if err == ErrTimeout {
+		return false, errors.New("sendHello: Timeout reception of HELLO_REPLY")
+	}
 	if err != nil {
 		PrintError("sendHello: Write to UDP failure\n")
 		return false, err
 	}
 
-	bufRes := make([]byte, DATAGRAM_SIZE)
-	timeStart := time.Now()
-
-	// try to receive HELLO_REPLY until a response HELLO_REPLY with the required ID will be received till TIMEOUT
-	for {
-		conn.SetReadDeadline(time.Now().Add(TIMEOUT)) // set Timeout
-
-		//recieve HELLO_REPLY
-		l, _, err := conn.ReadFromUDP(bufRes)
-		if err != nil {
-			HandleFatalError(err, "sendHello: ReadFromUDP failure")
-			messCounter++
-			return false, err
-
-		}
-
-		bExit := false
-		rezCheck := CheckUDPIncomingPacket(bufRes, l, HELLO_REPLY, "HELLO_REPLY")
-		switch rezCheck {
-		case 0:
-			bExit = true
-		case 1: // exit from function to re-send HELLO
-			messCounter++
-			return false, errors.New("sendHello: The lenght of HELLO_REPLY recieved != expected one\n")
-
-		case 2: // reject and try to pull out the next response until TIMEOUT
-			timeNow := time.Now()
-
-			// if TIMEOUT -> exit from function to re-send HELLO
-			if timeStart.Sub(timeNow) >= TIMEOUT {
-				messCounter++
-				return false, errors.New("sendHello: Timeout reception of HELLO_REPLY\n")
-			} else {
-				continue
-			}
-		case 3: // exit from function to re-send HELLO
-			messCounter++
-			return false, errors.New("sendHello: Id HELLO_REPLY != Id HELLO\n")
-		}
-
-		if bExit {
-			break
-		}
+	if checkIncoming(m, HELLO_REPLY, m.Id) != 0 {
+		return false, fmt.Errorf("sendHello: %s received instead of HELLO_REPLY", TypeName(m.Type))
+	}
+	if err := openSession(conn, remoteAddr, m); err != nil {
+		UnexpectedMessage(fmt.Sprintf("sendHello: %v, data will travel in clear\n", err))
 	}
-	messCounter++
 	return true, nil
 }
 
-// Check incoming UDP datagramme by 3 parameters: length, type and id
-// Return:
-// 1 if length does not match expected length
-// 2 if type does not match expected type
-// 3 if id does not match expected id
-// 0 if all is ok
-func CheckUDPIncomingPacket(bufRes []byte, lenRecieved int, typeExp int, strTypeExp string) int {
+// Send "GetDatum" & Recieve "Datum"
+// Several calls can run concurrently on the same connection: replies are matched by the transaction table of conn.
+// Return: value of datum (node type + data)
+func GetDataByHash(conn *net.UDPConn, hash []byte, myPeer string) ([]byte, error) {
+	return getDataByHash(conn, hash, myPeer, nil)
+}
 
-	// check lenght  -> if error, exit from function to re-send request
-	hasToBe := binary.BigEndian.Uint16(bufRes[POS_LENGTH:POS_BODY]) + ID_SIZE + TYPE_SIZE + LENGTH_SIZE + SIGN_SIZE
+// GetDataByHash, calling onLoss (if not nil) each time the GetDatum has to be re-sent.
+// The local cache is consulted first, so a datum already received from any peer is not transferred again.
+func getDataByHash(conn *net.UDPConn, hash []byte, myPeer string, onLoss func()) ([]byte, error) {
 	if LOG_PRINT_DATA {
-		//fmt.Println("\n-------- check lenght -------------")
-		//fmt.Printf("readed    : %d\n", lenRecieved)
-		//fmt.Printf("has to be : %d\n", hasToBe)
-		//fmt.Println("---------------------\n")
-	}
-	if hasToBe != uint16(lenRecieved) {
-		st := fmt.Sprintf("The lenght of %s recieved != expected one", strTypeExp)
-		PrintError(st)
-		return 1
+		fmt.Printf(">GetDataByHash(..., %v..., %s)\n", hash[0:32], myPeer)
 	}
-
-	// check type -> if error, reject and wait the next response
-	if CheckTypeEquality(byte(typeExp), bufRes) == -1 {
-		return 2
+	if Cache != nil {
+		if value := Cache.Get(hash); value != nil {
+			return value, nil
+		}
 	}
+	return requestDatum(conn, hash, myPeer, onLoss)
+}
 
-	// check id  -> if error, exit from function to re-send request
-	id := binary.BigEndian.Uint32(bufRes[:POS_TYPE])
+// Ask datum to peer, check it and store it in the local cache
+func requestDatum(conn *net.UDPConn, hash []byte, myPeer string, onLoss func()) ([]byte, error) {
 
-	if LOG_PRINT_DATA {
-		//fmt.Println("\n---------- check id -----------")
-		//fmt.Printf("REQUEST  id : %v\n", messCounter)
-		//fmt.Printf("RESPONSE id : %v\n", id)
-		//fmt.Printf("typeMess  %v\n", bufRes[4:5])
-		//fmt.Printf("lenMess   %v\n", bufRes[5:7])
-		//fmt.Printf("response  %v\n\n", string(bufRes[7:7+binary.BigEndian.Uint16(bufRes[5:7])]))
-		//fmt.Println("---------------------\n")
+	// send GetDatum and receive the reply with the same Id
+	m, err := GetTransactions(conn).RequestWithLoss(nil, NewHashMessage(0, GET_DATUM, hash), DATUM_TIMEOUT, onLoss)
+	if err == ErrTimeout {
+		return nil, errors.New("GetDataByHash: Timeout reception of DATUM")
 	}
-	if id != messCounter {
-		st := fmt.Sprintf("Id of request %d != id of response %d\n", messCounter, id)
-		PrintError(st)
-		return 3
+	if err != nil {
+		PrintError("GetDataByHash: Write to UDP failure\n")
+		return nil, err
 	}
-	return 0
-}
 
-// Send "GetDatum" & Recieve "Datum"
-// Return: list of strObjects
-func GetDataByHash(conn *net.UDPConn, hash []byte, myPeer string) ([]byte, error) {
-	if LOG_PRINT_DATA {
-		fmt.Printf(">GetDataByHash(..., %v..., %s)\n", hash[0:32], myPeer)
+	// check type
+	switch m.Type {
+	case DATUM:
+	case NO_DATUM:
+		UnexpectedMessage("GetDataByHash: NO_DATUM was received\n")
+		return nil, NoDatumRecieved()
+	default:
+		UnexpectedMessage("GetDataByHash: neither DATUM nor NO_DATUM was received\n")
+		return nil, errors.New("GetDataByHash: neither DATUM nor NO_DATUM was received")
 	}
 
-	// send GetDatum
-	buf := composeGetDatumMessage(messCounter, byte(GET_DATUM), myPeer, HASH_SIZE, hash, 0)
-	bufRes := make([]byte, DATAGRAM_SIZE)
-
-	timeStart := time.Now()
-
-	resendRequest := true
-
-	// receive Datum until a response with the required ID is received
-	for {
-		if time.Now().Sub(timeStart) >= 30*time.Second {
-			messCounter++
-			return nil, errors.New("GetDataByHash: Timeout reception of DATUM")
-		}
-
-		if resendRequest {
-			resendRequest = false
-			_, err := conn.Write(buf)
-			if err != nil {
-				PrintError("GetDataByHash: Write to UDP failure\n")
-				return nil, err
-			}
-		}
-
-		conn.SetReadDeadline(time.Now().Add(2 * time.Second)) // set Timeout
-
-		// receive Datum
-		all, _, err := conn.ReadFromUDP(bufRes)
-
-		if err != nil {
-			if err != io.EOF {
-				PrintError("GetDataByHash: timeout, resend\n")
-				resendRequest = true
-				continue
-			}
-		}
-
-		//if err != nil {
-		//	e, ok := err.(net.Error)
-		//	if !ok || !e.Timeout() {
-		//		messCounter++
-		//		HandleFatalError(err, "GetDataByHash: ReadFromUDP")
-		//		return nil, err
-		//	} else if e.Timeout() {
-		//		PrintError("GetDataByHash: timeout, resend\n")
-		//		resendRequest = true
-		//		continue
-		//	}
-		//}
-
-		// check id
-		if binary.BigEndian.Uint32(bufRes[:POS_TYPE]) == messCounter {
-			// check type
-			if CheckTypeEquality(byte(DATUM), bufRes) == -1 {
-				if CheckTypeEquality(byte(NO_DATUM), bufRes) == -1 {
-					messCounter++
-					UnexpectedMessage("GetDataByHash: neither DATUM nor NO_DATUM was received\n")
-					return nil, errors.New("GetDataByHash: neither DATUM nor NO_DATUM was received")
-				} else {
-					messCounter++
-					UnexpectedMessage("GetDataByHash: NO_DATUM was received\n")
-					return nil, NoDatumRecieved()
-				}
-			}
-			if LOG_PRINT_DATA {
-				fmt.Printf("Was recieved %d bytes at all\n", all)
-				fmt.Printf("Length     = %d bytes \n", binary.BigEndian.Uint16(bufRes[POS_LENGTH:POS_HASH]))
-			}
-			// find lenght of value = Length - HASH_SIZE
-			lenValue := binary.BigEndian.Uint16(bufRes[POS_LENGTH:POS_HASH]) - HASH_SIZE
-
-			if LOG_PRINT_DATA {
-				fmt.Printf("Was recieved %d bytes of value\n", lenValue)
-			}
-			// Check hash 1 : if hash in GetDatum == hash in DATUM
-			for i := 0; i < HASH_SIZE; i++ {
-				if hash[i] != bufRes[POS_HASH+i] {
-					messCounter++
-					return nil, errors.New("GetDataByHash: Data substitution !!! The hash I received is not the one I've asked for")
-				}
-			}
-
-			value := bufRes[POS_VALUE:(POS_VALUE + lenValue)]
-
-			// Check hash 2 : if hash in DATUM is really hash of value (there was no value substitution)
-			hashedValue := sha256.Sum256(value)
-			for i := 0; i < HASH_SIZE; i++ {
-				if hashedValue[i] != hash[i] {
-					messCounter++
-					return nil, errors.New("GetDataByHash: Data substitution !!! The hash(value) does not match the one I've asked for")
-				}
-			}
+	hashDatum, value, _ := m.Datum()
+	if LOG_PRINT_DATA {
+		fmt.Printf("Was recieved %d bytes of value\n", len(value))
+	}
 
-			messCounter++
+	// Check hash 1 : if hash in GetDatum == hash in DATUM
+	if !bytes.Equal(hash, hashDatum) {
+		return nil, errors.New("GetDataByHash: Data substitution !!! The hash I received is not the one I've asked for")
+	}
 
-			if LOG_PRINT_DATA {
-				fmt.Printf("GetDataByHash Value: %v \n\n", value)
-			}
+	// Check hash 2 : if hash in DATUM is really hash of value (there was no value substitution)
+	hashedValue := sha256.Sum256(value)
+	if !bytes.Equal(hashedValue[:], hash) {
+		return nil, errors.New("GetDataByHash: Data substitution !!! The hash(value) does not match the one I've asked for")
+	}
 
-			return value, nil
+	if LOG_PRINT_DATA {
+		fmt.Printf("GetDataByHash Value: %v \n\n", value)
+	}
 
-		} else {
-			PanicMessage(fmt.Sprintf("GetDataByHash: MessageId DATUM %d != %d MessageId GET_DATUM\n", binary.BigEndian.Uint32(bufRes[:POS_TYPE]), messCounter))
-		}
+	if Cache != nil {
+		Cache.Put(hash, value)
 	}
-	return nil, nil
+	return value, nil
 }
 
 // Parser for data obtained by hash.
@@ -914,126 +709,3 @@ func ParceValue(data []byte) []StrObject {
 		return nil
 	}
 }
-
-// Download data from hash and create directory structure (files and folders)
-// Recursive function ! Used to download data to the depth of the directory structure.
-// Parameters:
-// - conn - UDP Connection
-// - hashPeer - hash of peer
-// - myPeer - name of my peer
-// - DataObj - data object, holds information about current file and directory
-func DownloadData(conn *net.UDPConn, hashPeer []byte, myPeer string, DataObj *DataObject) int {
-	if LOG_PRINT_DATA {
-		fmt.Printf(">DownloadData(..., %v..., %s, %s, %s)\n", hashPeer[0:32], myPeer, DataObj.Name, DataObj.Path)
-	}
-	value, _ := GetDataByHash(conn, hashPeer, myPeer)
-
-	if DataObj.Op == OP_PRINT_HASH {
-		fmt.Printf("%s <=> %s\n", filepath.Join(DataObj.Path, DataObj.Name), hex.EncodeToString(hashPeer))
-	}
-
-	if len(value) != 0 {
-		if LOG_PRINT_DATA {
-			fmt.Printf("DownloadData: Value from GetDataByHash : %v \n", value)
-		}
-
-		// Parcing the value recieved
-		var listContent []StrObject
-		listContent = ParceValue(value)
-
-		// Create the files and directories
-		for _, el := range listContent {
-			if el.Type == CHUNK {
-				if DataObj.Op == OP_DOWNLOAD_HASH {
-					if LOG_PRINT_DATA {
-						fmt.Printf("DownloadData: CHUNK for file %s\n", DataObj.Name)
-					}
-					if DataObj.Handle == nil {
-						FilePath := DataObj.HddPath
-						FilePath = filepath.Join(FilePath, DataObj.Name)
-						hndl, err := os.OpenFile(FilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
-						DataObj.Handle = hndl
-						if err != nil {
-							HandleFatalError(err, "DownloadData, open file")
-							return RESULT_ERROR
-						}
-					}
-
-					if _, err := DataObj.Handle.Write(el.Data); err != nil {
-						DataObj.Handle.Close()
-						DataObj.Handle = nil
-						HandleFatalError(err, "DownloadData, write")
-						return RESULT_ERROR
-					}
-				}
-			} else if el.Type == BIG_FILE {
-				if DataObj.Op == OP_DOWNLOAD_HASH {
-					if LOG_PRINT_DATA {
-						fmt.Printf("DownloadData: BIG_FILE for file %s\n", DataObj.Name)
-					}
-
-					point := 0
-
-					// The ParceValue function brought together all the hashes of a large file
-					// So to receive data, we need to send requests for each 32 byte pieces:
-					for i := 0; i < el.NbHash; i++ {
-						res := DownloadData(conn, el.Hash[point:point+HASH_SIZE], myPeer, DataObj)
-						point = point + HASH_SIZE
-						if res != RESULT_OK {
-							return res
-						}
-					}
-				}
-			} else if el.Type == NODE_UNKNOWN {
-
-				PeerDirPath := DataObj.Path
-				PeerDirPath = filepath.Join(PeerDirPath, DataObj.Name)
-
-				HddPath := DataObj.HddPath
-				HddPath = filepath.Join(HddPath, DataObj.Name)
-
-				opPrev := DataObj.Op
-
-				//if path has been found - start downloading data
-				if DataObj.Op == OP_DOWNLOAD_PATH {
-					FilePath := filepath.Join(PeerDirPath, el.Name)
-
-					if DataObj.SearchPath == PeerDirPath || DataObj.SearchPath == FilePath {
-						DataObj.Op = OP_DOWNLOAD_HASH
-					}
-				}
-
-				if DataObj.Op == OP_DOWNLOAD_HASH {
-					if _, err := os.Stat(HddPath); os.IsNotExist(err) {
-						os.Mkdir(HddPath, 0777)
-					}
-				}
-
-				if LOG_PRINT_DATA {
-					fmt.Println("=============================================================")
-					fmt.Printf("DownloadData: DIR for content %s of directory %s\n", el.Name, PeerDirPath)
-					fmt.Printf("Name : %s, Hash : %v\n", el.Name, el.Hash)
-				}
-
-				ChildObj := DataObject{DataObj.Op, NODE_UNKNOWN, el.Name, PeerDirPath, DataObj.SearchPath, HddPath, nil}
-				// recursive call
-				res := DownloadData(conn, el.Hash, myPeer, &ChildObj)
-				if res != RESULT_OK {
-					return res
-				}
-
-				if ChildObj.Handle != nil {
-					err := ChildObj.Handle.Close()
-					if err != nil {
-						HandleFatalError(err, "DownloadData, close")
-					}
-				}
-
-				DataObj.Op = opPrev
-			} else {
-				// do nothing
-			}
-		}
-	}
-	return RESULT_OK
-}
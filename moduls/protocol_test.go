@@ -0,0 +1,53 @@
+package moduls
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Transport answering every request of a client with what the function returns
+type cannedTransport func(req *http.Request) (*http.Response, error)
+
+func (f cannedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Only a 200 with a well-formed key or a 204 is an answer about the key of the peer, anything else is an error
+func TestPeerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KEY_SIZE)
+	tests := []struct {
+		name   string
+		status int // 0: the request fails
+		body   []byte
+		key    []byte
+		err    bool
+	}{
+		{"key", 200, key, key, false},
+		{"no key", 204, nil, nil, false},
+		{"malformed key", 200, key[1:], nil, true},
+		{"unknown peer", 404, nil, nil, true},
+		{"server error", 500, nil, nil, true},
+		{"no answer", 0, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: cannedTransport(func(req *http.Request) (*http.Response, error) {
+				if !strings.HasSuffix(req.URL.Path, "/peers/peer/key") {
+					t.Errorf("request for %s", req.URL)
+				}
+				if tt.status == 0 {
+					return nil, errors.New("connection refused")
+				}
+				return &http.Response{StatusCode: tt.status, Body: io.NopCloser(bytes.NewReader(tt.body))}, nil
+			})}
+			got, err := PeerKey(client, "peer")
+			if !bytes.Equal(got, tt.key) || (err != nil) != tt.err {
+				t.Errorf("PeerKey = %x, %v, want %x, error %v", got, err, tt.key, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package moduls
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Retransmission timer (RFC 6298)
+const (
+	RTO_INITIAL = 1 * time.Second       // before the first measure
+	RTO_MIN     = 10 * time.Millisecond // so a LAN peer is retried in milliseconds
+	RTO_MAX     = 10 * time.Second      // cap of the exponential backoff
+	RTT_ALPHA   = 0.125                 // gain of smoothed RTT
+	RTT_BETA    = 0.25                  // gain of RTT variance
+	RTT_K       = 4
+)
+
+// Smoothed RTT and RTT variance of one peer, and the retransmission timeout derived from them
+type RttEstimator struct {
+	mutex  sync.Mutex
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	valid  bool // at least one measure was taken
+}
+
+func NewRttEstimator() *RttEstimator {
+	return &RttEstimator{rto: RTO_INITIAL}
+}
+
+// Current retransmission timeout
+func (e *RttEstimator) Timeout() time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.rto
+}
+
+// Smoothed RTT, 0 if not measured yet
+func (e *RttEstimator) Srtt() time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.srtt
+}
+
+// Take a measure of RTT.
+// Following Karn's algorithm the caller must only measure replies to requests sent once,
+// since the reply to a retransmitted request can't be matched to one of the transmissions.
+func (e *RttEstimator) Sample(rtt time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.valid {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.valid = true
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = time.Duration((1-RTT_BETA)*float64(e.rttvar) + RTT_BETA*float64(delta))
+		e.srtt = time.Duration((1-RTT_ALPHA)*float64(e.srtt) + RTT_ALPHA*float64(rtt))
+	}
+	e.rto = clampRto(e.srtt + RTT_K*e.rttvar)
+}
+
+// Double the timeout after a loss.
+// armed is the timeout the lost request was waiting for: when several requests in flight time out together,
+// only the first one backs off, the others find the timeout already doubled.
+func (e *RttEstimator) Backoff(armed time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.rto <= armed {
+		e.rto = clampRto(2 * armed)
+	}
+}
+
+func clampRto(rto time.Duration) time.Duration {
+	if rto < RTO_MIN {
+		return RTO_MIN
+	}
+	if rto > RTO_MAX {
+		return RTO_MAX
+	}
+	return rto
+}
+
+var rttMutex sync.Mutex
+var rttPeers = map[string]*RttEstimator{}
+
+// Get RTT estimator of the peer at addr, creating it at first use
+func PeerRtt(addr net.Addr) *RttEstimator {
+	key := ""
+	if addr != nil {
+		key = addr.String()
+	}
+
+	rttMutex.Lock()
+	defer rttMutex.Unlock()
+	e, ok := rttPeers[key]
+	if !ok {
+		e = NewRttEstimator()
+		rttPeers[key] = e
+	}
+	return e
+}
@@ -0,0 +1,89 @@
+package moduls
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRttSample(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		srtt    time.Duration
+		rttvar  time.Duration
+		rto     time.Duration
+	}{
+		{"none", nil, 0, 0, RTO_INITIAL},
+		{"first measure", []time.Duration{100 * ms}, 100 * ms, 50 * ms, 300 * ms},
+		{"second measure", []time.Duration{100 * ms, 200 * ms}, 112500 * time.Microsecond, 62500 * time.Microsecond, 362500 * time.Microsecond},
+		{"steady", []time.Duration{100 * ms, 100 * ms}, 100 * ms, 37500 * time.Microsecond, 250 * ms},
+		{"lan peer", []time.Duration{ms}, ms, ms / 2, RTO_MIN},
+		{"slow peer", []time.Duration{5 * time.Second}, 5 * time.Second, 2500 * ms, RTO_MAX},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewRttEstimator()
+			for _, rtt := range tt.samples {
+				e.Sample(rtt)
+			}
+			if e.Srtt() != tt.srtt || e.rttvar != tt.rttvar || e.Timeout() != tt.rto {
+				t.Errorf("srtt %v, rttvar %v, rto %v; want %v, %v, %v", e.Srtt(), e.rttvar, e.Timeout(), tt.srtt, tt.rttvar, tt.rto)
+			}
+		})
+	}
+}
+
+func TestRttBackoff(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name  string
+		rto   time.Duration // before the loss
+		armed time.Duration // timeout the lost request waited for
+		want  time.Duration
+	}{
+		{"first loss doubles", 300 * ms, 300 * ms, 600 * ms},
+		{"request armed before a backoff", 600 * ms, 300 * ms, 600 * ms},
+		{"rto lowered by a measure meanwhile", 200 * ms, 300 * ms, 600 * ms},
+		{"capped", 6 * time.Second, 6 * time.Second, RTO_MAX},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &RttEstimator{rto: tt.rto}
+			e.Backoff(tt.armed)
+			if e.Timeout() != tt.want {
+				t.Errorf("rto %v after backoff, want %v", e.Timeout(), tt.want)
+			}
+		})
+	}
+}
+
+// Karn's algorithm: the reply to a retransmitted request is not measured
+func TestExchangeSkipsRetransmittedSample(t *testing.T) {
+	peer, conn := loopbackPair(t)
+
+	// the peer loses the first request and answers the second one
+	sent := 0
+	answerWith(peer, func(m *Message) *Message {
+		sent++
+		if sent == 1 {
+			return nil
+		}
+		return NewHashMessage(m.Id, NO_DATUM, m.Body)
+	})
+
+	rtt := PeerRtt(conn.RemoteAddr())
+	rtt.Sample(time.Millisecond)
+	srtt, rto := rtt.Srtt(), rtt.Timeout()
+
+	request := NewHashMessage(1, GET_DATUM, make([]byte, HASH_SIZE))
+	if _, err := exchange(conn, nil, request, TIMEOUT); err != nil {
+		t.Fatal(err)
+	}
+	if rtt.Srtt() != srtt {
+		t.Errorf("srtt %v after a retransmission, was %v", rtt.Srtt(), srtt)
+	}
+	if rtt.Timeout() < 2*rto {
+		t.Errorf("rto %v after a loss, want at least %v", rtt.Timeout(), 2*rto)
+	}
+}
@@ -0,0 +1,121 @@
+package moduls
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A tree published by Merkelify and served like Server mode downloads back as the same files
+func TestServeAndDownload(t *testing.T) {
+	files := map[string][]byte{
+		"empty file":       nil,
+		"one byte":         {1},
+		"one chunk":        testContent(CHUNK_SIZE),
+		"sub/two levels":   testContent(33*CHUNK_SIZE + 5),
+		"sub/deeper/three": testContent(MAX_CHILDREN*CHUNK_SIZE*32 + 1),
+		"sub/empty dir/":   nil,
+	}
+	for i := 0; i < 40; i++ {
+		files[fmt.Sprintf("many/%02d", i)] = []byte{byte(i)} // split in parts
+	}
+	share := writeShare(t, files)
+	root := Merkelify(share)
+	conn := serveTree(t, root)
+
+	tests := []struct {
+		name   string
+		obj    DataObject
+		hash   []byte
+		source string // what must be downloaded
+	}{
+		{"whole tree by hash", DataObject{Op: OP_DOWNLOAD_HASH}, root.Hash, share},
+		{"directory by path", DataObject{Op: OP_DOWNLOAD_PATH, Path: "/", SearchPath: "/sub/deeper"}, root.Hash, filepath.Join(share, "sub", "deeper")},
+		{"split directory by path", DataObject{Op: OP_DOWNLOAD_PATH, Path: "/", SearchPath: "/many"}, root.Hash, filepath.Join(share, "many")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			obj := tt.obj
+			obj.Type, obj.HddPath = NODE_UNKNOWN, out
+			if DownloadData(conn, tt.hash, "me", &obj) != RESULT_OK {
+				t.Fatal("download failed")
+			}
+			got := out
+			if tt.obj.Op == OP_DOWNLOAD_PATH {
+				got = filepath.Join(out, filepath.FromSlash(tt.obj.SearchPath))
+			}
+			sameFiles(t, tt.source, got)
+		})
+	}
+	if _, err := GetDataByHash(conn, make([]byte, HASH_SIZE), "me"); err == nil {
+		t.Error("unknown hash served")
+	}
+}
+
+// Peers are served while the socket shared with the server waits for a RootReply, like in Server mode
+func TestServeWhileAnnouncing(t *testing.T) {
+	share := writeShare(t, map[string][]byte{
+		"a":     testContent(3*CHUNK_SIZE + 1),
+		"sub/b": testContent(40 * CHUNK_SIZE),
+	})
+	root := Merkelify(share)
+	ShareTree(&root)
+
+	// the server and the peer reach the same unconnected socket
+	var sockets [2]*net.UDPConn
+	for i := range sockets {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		sockets[i] = c
+	}
+	server, served := sockets[0], sockets[1]
+
+	// the server holds the Root until the peer has downloaded the tree
+	received, release := make(chan struct{}, 1), make(chan struct{})
+	answerWith(server, func(m *Message) *Message {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		<-release
+		return NewHashMessage(m.Id, ROOT_REPLY, m.Body)
+	})
+
+	ServeIncoming(served, "peer")
+	t.Cleanup(func() { CloseTransactions(served) })
+	announced := make(chan error, 1)
+	go func() {
+		m, err := exchange(served, server.LocalAddr().(*net.UDPAddr), NewHashMessage(0, ROOT, root.Hash), 10*time.Second)
+		if err == nil && m.Type != ROOT_REPLY {
+			err = fmt.Errorf("%s received instead of ROOT_REPLY", TypeName(m.Type))
+		}
+		announced <- err
+	}()
+	<-received
+
+	conn, err := net.DialUDP("udp", nil, served.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		CloseTransactions(conn)
+		conn.Close()
+	})
+	out := t.TempDir()
+	obj := DataObject{Op: OP_DOWNLOAD_HASH, Type: NODE_UNKNOWN, HddPath: out}
+	result := DownloadData(conn, root.Hash, "me", &obj)
+	close(release)
+	if result != RESULT_OK {
+		t.Fatal("download failed")
+	}
+	sameFiles(t, share, out)
+	if err := <-announced; err != nil {
+		t.Errorf("Root: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Offer encrypted sessions to the peers we greet, and accept them (set by "encryption=on" in config).
+// A session is opened after a Hello exchange where both sides set EXTENSION_ENCRYPTION:
+// each side sends an ephemeral ECDH key signed with its identity (SessionKey, SessionKeyReply),
+// then GetDatum, Datum and NoDatum travel inside Sealed messages, encrypted with AES-GCM.
+// Peers that don't set the bit are talked to in clear text.
+var EncryptSessions = false
+
+// Bits of the extensions of Hello and HelloReply we use, all listed here.
+// The protocol reserves none for an implementation, so ours are taken from the top bit down,
+// leaving the low bits to extensions peers may agree on later.
+// A peer that gives the same bit another meaning won't answer SessionKey, and is talked to in clear text.
+const (
+	EXTENSION_ENCRYPTION uint32 = 1 << 31 // the sender can open an encrypted session
+)
+
+const (
+	NONCE_SIZE = 12 // of AES-GCM
+	TAG_SIZE   = 16 // of AES-GCM
+)
+
+// Ends of an encrypted session with the node at an address
+type session struct {
+	seal cipher.AEAD // what we send
+	open cipher.AEAD // what we receive
+
+	// on the responder side, SessionKey that opened it and our reply, sent again if the SessionKey is repeated
+	request []byte
+	reply   *Message
+}
+
+// Sessions open, by address of the peer
+var sessionsMutex sync.Mutex
+var sessions = map[string]*session{}
+
+// Extensions we set in Hello and HelloReply
+func helloExtensions() uint32 {
+	if EncryptSessions && MyIdentity() != nil {
+		return EXTENSION_ENCRYPTION
+	}
+	return 0
+}
+
+// Address of the node a message is sent to or received from (remoteAddr is nil for connected sockets)
+func peerAddr(conn *net.UDPConn, remoteAddr *net.UDPAddr) string {
+	if remoteAddr != nil {
+		return remoteAddr.String()
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+func getSession(addr string) *session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return sessions[addr]
+}
+
+// Open an encrypted session with the peer that just answered our Hello with reply, if we both want one.
+// Only the side that greets opens sessions: after NatTraversal, it is the Hello sent once the NAT let the peer through.
+// The session we had with it before, if any, ends: the new Hello starts over.
+// The peer must have a known key, to check that the ephemeral key it sends is its own.
+func openSession(conn *net.UDPConn, remoteAddr *net.UDPAddr, reply *Message) error {
+	sessionsMutex.Lock()
+	delete(sessions, peerAddr(conn, remoteAddr))
+	sessionsMutex.Unlock()
+
+	extensions, name, err := reply.Hello()
+	if err != nil || helloExtensions()&EXTENSION_ENCRYPTION == 0 || extensions&EXTENSION_ENCRYPTION == 0 {
+		return nil
+	}
+	if !signedBySender(reply, remoteAddrOf(conn, remoteAddr)) {
+		awaitSenderKey(reply, remoteAddrOf(conn, remoteAddr))
+	}
+	if !signedBySender(reply, remoteAddrOf(conn, remoteAddr)) {
+		return fmt.Errorf("session with %s: its key is unknown, its ephemeral key can't be checked", name)
+	}
+
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	request := &Message{Id: messCounter, Type: SESSION_KEY, Body: formatEcdhKey(ephemeral.PublicKey())}
+	messCounter++
+	m, err := exchange(conn, remoteAddr, request, TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("session with %s: %w", name, err)
+	}
+	if checkIncoming(m, SESSION_KEY_REPLY, request.Id) != 0 {
+		return fmt.Errorf("session with %s: %s received instead of SESSION_KEY_REPLY", name, TypeName(m.Type))
+	}
+	if !signedBySender(m, remoteAddrOf(conn, remoteAddr)) {
+		return fmt.Errorf("session with %s: SESSION_KEY_REPLY not signed with its key", name)
+	}
+
+	s, err := newSession(ephemeral, m.Body, request.Body, m.Body, true)
+	if err != nil {
+		return fmt.Errorf("session with %s: %w", name, err)
+	}
+	sessionsMutex.Lock()
+	sessions[peerAddr(conn, remoteAddr)] = s
+	sessionsMutex.Unlock()
+	fmt.Printf("Encrypted session opened with %s\n", name)
+	return nil
+}
+
+// Answer the SessionKey of a peer that greeted us, and open the session
+// Return: status like ReplyToIncoming
+func acceptSession(conn *net.UDPConn, remoteAddr *net.UDPAddr, m *Message) int {
+	if helloExtensions()&EXTENSION_ENCRYPTION == 0 {
+		return 404
+	}
+	if !signedBySender(m, remoteAddr) {
+		UnexpectedMessage(fmt.Sprintf("SESSION_KEY from %s not signed with the key of the peer, refused", remoteAddr))
+		return 401
+	}
+	if s := getSession(remoteAddr.String()); s != nil && s.reply != nil && bytes.Equal(s.request, m.Body) {
+		// our reply was lost: the peer must get the same key again
+		if err := writeMessage(conn, remoteAddr, s.reply); err != nil {
+			HandlePanicError(err, "acceptSession")
+			return 404
+		}
+		return 200
+	}
+
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		HandlePanicError(err, "acceptSession")
+		return 500
+	}
+	reply := &Message{Id: m.Id, Type: SESSION_KEY_REPLY, Body: formatEcdhKey(ephemeral.PublicKey())}
+	s, err := newSession(ephemeral, m.Body, m.Body, reply.Body, false)
+	if err != nil {
+		HandlePanicError(err, fmt.Sprintf("SESSION_KEY from %s", remoteAddr))
+		return 400
+	}
+	s.request = m.Body
+	s.reply = reply
+	// sent in clear: the session starts with the next message
+	if err := writeMessage(conn, remoteAddr, reply); err != nil {
+		HandlePanicError(err, "acceptSession")
+		return 404
+	}
+	sessionsMutex.Lock()
+	sessions[remoteAddr.String()] = s
+	sessionsMutex.Unlock()
+	return 200
+}
+
+// Address of the peer of conn, as readMessage reports it
+func remoteAddrOf(conn *net.UDPConn, remoteAddr *net.UDPAddr) *net.UDPAddr {
+	if remoteAddr != nil {
+		return remoteAddr
+	}
+	addr, _ := conn.RemoteAddr().(*net.UDPAddr)
+	return addr
+}
+
+// Is m signed with the key of the node at from, learnt from its Hello or HelloReply
+func signedBySender(m *Message, from *net.UDPAddr) bool {
+	if len(m.Signature) == 0 || from == nil {
+		return false
+	}
+	keysMutex.Lock()
+	key := keysByAddr[from.String()]
+	keysMutex.Unlock()
+	return key != nil && CheckSignature(m.signedBytes(), m.Signature, key)
+}
+
+// Keys of a session from our ephemeral key and the one of the peer (64 bytes, X and Y).
+// Both keys are mixed into the secret, and each direction gets its own key.
+// initiator: we sent the SessionKey
+func newSession(ephemeral *ecdh.PrivateKey, peerKey []byte, initiatorKey []byte, responderKey []byte, initiator bool) (*session, error) {
+	public, err := ecdh.P256().NewPublicKey(append([]byte{4}, peerKey...))
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+
+	// HKDF-SHA256 (RFC 5869), one block per key
+	extract := hmac.New(sha256.New, append(append([]byte(nil), initiatorKey...), responderKey...))
+	extract.Write(shared)
+	prk := extract.Sum(nil)
+	derive := func(label string) (cipher.AEAD, error) {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write([]byte(label))
+		expand.Write([]byte{1})
+		block, err := aes.NewCipher(expand.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	toResponder, err := derive("betweenus session initiator to responder")
+	if err != nil {
+		return nil, err
+	}
+	toInitiator, err := derive("betweenus session responder to initiator")
+	if err != nil {
+		return nil, err
+	}
+	if initiator {
+		return &session{seal: toResponder, open: toInitiator}, nil
+	}
+	return &session{seal: toInitiator, open: toResponder}, nil
+}
+
+// ECDH public key as sent in SessionKey: X and Y, 32 bytes each (without the 0x04 prefix)
+func formatEcdhKey(key *ecdh.PublicKey) []byte {
+	return key.Bytes()[1:]
+}
+
+// A Hello from the node at from without EXTENSION_ENCRYPTION ends our session with it:
+// it was restarted without encryption and can't read Sealed messages anymore
+func helloReceived(m *Message, from *net.UDPAddr) {
+	extensions, _, err := m.Hello()
+	if err != nil || extensions&EXTENSION_ENCRYPTION != 0 || from == nil {
+		return
+	}
+	sessionsMutex.Lock()
+	delete(sessions, from.String())
+	sessionsMutex.Unlock()
+}
+
+// Is m sent inside a Sealed message when a session is open
+func sealable(typeMes byte) bool {
+	return typeMes == GET_DATUM || typeMes == DATUM || typeMes == NO_DATUM
+}
+
+// Header fields the encryption of a Sealed message is bound to: its Id and type
+func sealedData(id uint32, typeMes byte) []byte {
+	data := make([]byte, ID_SIZE+TYPE_SIZE)
+	binary.BigEndian.PutUint32(data, id)
+	data[ID_SIZE] = typeMes
+	return data
+}
+
+// Sealed message carrying m if a session is open with the node at addr, nil otherwise.
+// Body: nonce | AES-GCM of (type of m | body of m)
+func sealMessage(addr string, m *Message) *Message {
+	if !sealable(m.Type) {
+		return nil
+	}
+	s := getSession(addr)
+	if s == nil {
+		return nil
+	}
+	typeMes := byte(SEALED)
+	if isReply(m.Type) {
+		typeMes = SEALED_REPLY
+	}
+	nonce := make([]byte, NONCE_SIZE)
+	rand.Read(nonce)
+	plain := append([]byte{m.Type}, m.Body...)
+	body := s.seal.Seal(nonce, nonce, plain, sealedData(m.Id, typeMes))
+	return &Message{Id: m.Id, Type: typeMes, Body: body}
+}
+
+// Message m received from from, or the message it carries if it is a Sealed one
+func openMessage(m *Message, from *net.UDPAddr) (*Message, error) {
+	if m.Type != SEALED && m.Type != SEALED_REPLY {
+		return m, nil
+	}
+	addr := ""
+	if from != nil {
+		addr = from.String()
+	}
+	return unsealMessage(addr, m)
+}
+
+// Message carried by Sealed message m, received from the node at addr
+// Return: a *MessageError if there is no session with it or m was not sealed with its key
+func unsealMessage(addr string, m *Message) (*Message, error) {
+	s := getSession(addr)
+	if s == nil {
+		return nil, &MessageError{m.Type, ErrNoSession, "from " + addr}
+	}
+	plain, err := s.open.Open(nil, m.Body[:NONCE_SIZE], m.Body[NONCE_SIZE:], sealedData(m.Id, m.Type))
+	if err != nil {
+		return nil, &MessageError{m.Type, ErrUnsealed, fmt.Sprintf("from %s: %v", addr, err)}
+	}
+
+	inner := &Message{Id: m.Id, Type: plain[0], Body: plain[1:]}
+	if !sealable(inner.Type) || isReply(inner.Type) != isReply(m.Type) {
+		return nil, &MessageError{m.Type, ErrUnexpectedType, fmt.Sprintf("%s inside", TypeName(inner.Type))}
+	}
+	if err := checkBody(inner.Type, inner.Body); err != nil {
+		return nil, err
+	}
+	return inner, nil
+}
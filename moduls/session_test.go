@@ -0,0 +1,163 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// Both ends of a session, as openSession and acceptSession make them:
+// the initiator's under address "responder", the responder's under address "initiator"
+func testSessions(t *testing.T) {
+	t.Helper()
+	initiatorKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, reply := formatEcdhKey(initiatorKey.PublicKey()), formatEcdhKey(responderKey.PublicKey())
+
+	initiator, err := newSession(initiatorKey, reply, request, reply, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := newSession(responderKey, request, request, reply, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionsMutex.Lock()
+	sessions["responder"] = initiator
+	sessions["initiator"] = responder
+	sessionsMutex.Unlock()
+	t.Cleanup(func() {
+		sessionsMutex.Lock()
+		delete(sessions, "responder")
+		delete(sessions, "initiator")
+		sessionsMutex.Unlock()
+	})
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	testSessions(t)
+	hash := bytes.Repeat([]byte{3}, HASH_SIZE)
+	tests := []struct {
+		name string
+		m    *Message
+		to   string // address the sender seals for
+		from string // address the receiver opens from
+	}{
+		{"get datum to the responder", NewHashMessage(1, GET_DATUM, hash), "responder", "initiator"},
+		{"datum to the initiator", NewDatumMessage(2, hash, append([]byte{CHUNK}, make([]byte, CHUNK_SIZE)...)), "initiator", "responder"},
+		{"no datum to the initiator", NewHashMessage(3, NO_DATUM, hash), "initiator", "responder"},
+		{"get datum to the initiator", NewHashMessage(4, GET_DATUM, hash), "initiator", "responder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := sealMessage(tt.to, tt.m)
+			if sealed == nil {
+				t.Fatal("not sealed")
+			}
+			wantType := byte(SEALED)
+			if isReply(tt.m.Type) {
+				wantType = SEALED_REPLY
+			}
+			if sealed.Type != wantType {
+				t.Errorf("sealed as %s, want %s", TypeName(sealed.Type), TypeName(wantType))
+			}
+			if bytes.Contains(sealed.Body, tt.m.Body) {
+				t.Error("body sent in clear")
+			}
+			// through the wire format, as readMessage gets it
+			data, err := sealed.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var received Message
+			if err := received.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			opened, err := unsealMessage(tt.from, &received)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opened.Id != tt.m.Id || opened.Type != tt.m.Type || !bytes.Equal(opened.Body, tt.m.Body) {
+				t.Errorf("opened %s %d, sent %s %d", TypeName(opened.Type), opened.Id, TypeName(tt.m.Type), tt.m.Id)
+			}
+		})
+	}
+}
+
+func TestSealNotApplied(t *testing.T) {
+	testSessions(t)
+	tests := []struct {
+		name string
+		m    *Message
+		to   string
+	}{
+		{"hello stays in clear", NewHelloMessage(1, HELLO, EXTENSION_ENCRYPTION, "peer"), "responder"},
+		{"session key stays in clear", &Message{Id: 2, Type: SESSION_KEY, Body: make([]byte, KEY_SIZE)}, "responder"},
+		{"no session with the peer", NewHashMessage(3, GET_DATUM, make([]byte, HASH_SIZE)), "elsewhere"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if sealed := sealMessage(tt.to, tt.m); sealed != nil {
+				t.Errorf("sealed as %s", TypeName(sealed.Type))
+			}
+		})
+	}
+}
+
+func TestUnsealRejects(t *testing.T) {
+	testSessions(t)
+	get := NewHashMessage(7, GET_DATUM, make([]byte, HASH_SIZE))
+	sealedGet := func() *Message { return sealMessage("responder", get) }
+
+	tests := []struct {
+		name   string
+		sealed func() *Message
+		from   string
+		err    error
+	}{
+		{"no session", sealedGet, "elsewhere", ErrNoSession},
+		{"opened by the side that sealed it", sealedGet, "responder", ErrUnsealed},
+		{"byte of ciphertext changed", func() *Message {
+			m := sealedGet()
+			m.Body[NONCE_SIZE] ^= 1
+			return m
+		}, "initiator", ErrUnsealed},
+		{"nonce changed", func() *Message {
+			m := sealedGet()
+			m.Body[0] ^= 1
+			return m
+		}, "initiator", ErrUnsealed},
+		{"id changed", func() *Message {
+			m := sealedGet()
+			m.Id++
+			return m
+		}, "initiator", ErrUnsealed},
+		{"request passed off as a reply", func() *Message {
+			m := sealedGet()
+			m.Type = SEALED_REPLY
+			return m
+		}, "initiator", ErrUnsealed},
+		{"hello inside", func() *Message {
+			hello := NewHelloMessage(8, HELLO, 0, "peer")
+			nonce := make([]byte, NONCE_SIZE)
+			plain := append([]byte{hello.Type}, hello.Body...)
+			s := getSession("responder")
+			return &Message{Id: 8, Type: SEALED, Body: s.seal.Seal(nonce, nonce, plain, sealedData(8, SEALED))}
+		}, "initiator", ErrUnexpectedType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := unsealMessage(tt.from, tt.sealed()); !errors.Is(err, tt.err) {
+				t.Errorf("unsealMessage = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
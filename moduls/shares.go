@@ -0,0 +1,98 @@
+package moduls
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A directory or file published under a name of its own in the root of the tree, next to other ones
+type Share struct {
+	Name string
+	Path string
+}
+
+// Shares published together (set by "share=name=path" lines in config), none when a single path is published
+var Shares []Share
+
+// Add the share of path, published as name, to Shares
+func AddShare(name string, path string) error {
+	switch problem := nameProblem(name); {
+	case problem != "":
+		return fmt.Errorf("share %q: %s", name, problem)
+	case len(name) > NAME_SIZE:
+		return fmt.Errorf("share %q: name longer than %d bytes", name, NAME_SIZE)
+	case isSplitDirectory(name):
+		return fmt.Errorf("share %q: name reserved for split directories", name)
+	case path == "":
+		return fmt.Errorf("share %q: no path", name)
+	}
+	for _, s := range Shares {
+		if s.Name == name {
+			return fmt.Errorf("share %q: name already used for %s", name, s.Path)
+		}
+	}
+	Shares = append(Shares, Share{Name: name, Path: path})
+	return nil
+}
+
+// Build the tree of each share, with its own ignore files, hash cache and state directory,
+// and serve them together, each mounted under its name in a virtual root directory
+func MerkelifyShares(shares []Share) Node {
+	mounts := make([]Node, len(shares))
+	for i, s := range shares {
+		r, b := build(s.Path)
+		b.finish(r, true)
+		mounts[i] = mount(s.Name, r)
+	}
+	root := sharesRoot(mounts)
+	ShareTree(&root)
+	return root
+}
+
+// Print what MerkelifyShares would publish from shares, the root hash, and what is left out, without serving it
+func DryRunShares(shares []Share) {
+	mounts := make([]Node, len(shares))
+	for i, s := range shares {
+		r, b := build(s.Path)
+		fmt.Printf("Would publish %s as /%s:\n", s.Path, s.Name)
+		b.dryRun(r, "/"+s.Name)
+		mounts[i] = mount(s.Name, r)
+	}
+	root := sharesRoot(mounts)
+	fmt.Printf("Root: %x\n", root.Hash)
+}
+
+// Tree of a share as an entry of the virtual root
+func mount(name string, tree Node) Node {
+	tree.Name = name
+	return tree
+}
+
+// Virtual root directory of several shares: one entry per share, in name order.
+// It has no path on disk.
+func sharesRoot(mounts []Node) Node {
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Name < mounts[j].Name })
+	root := Node{
+		NodeType: DIRECTORY,
+		Children: splitDirectory("", mounts),
+	}
+	root.Hash = directoryHash(root.Children)
+	return root
+}
+
+// Is tree the virtual root of several shares
+func isSharesRoot(tree Node) bool {
+	return tree.NodeType == DIRECTORY && tree.Path == ""
+}
+
+// Paths on disk of the shares of tree
+func sharePaths(tree Node) []string {
+	if !isSharesRoot(tree) {
+		return []string{tree.Path}
+	}
+	var paths []string
+	for _, m := range flattenDirectory(tree.Children) {
+		paths = append(paths, m.Path)
+	}
+	return paths
+}
@@ -0,0 +1,87 @@
+package moduls
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddShare(t *testing.T) {
+	defer func(shares []Share) { Shares = shares }(Shares)
+	Shares = []Share{{Name: "taken", Path: "/tmp"}}
+
+	tests := []struct {
+		name    string
+		path    string
+		problem string // in the error, "" if the share is added
+	}{
+		{"docs", "/tmp/docs", ""},
+		{"taken", "/tmp/other", "already used"},
+		{"a/b", "/tmp", "/"},
+		{"..", "/tmp", "not allowed"},
+		{"", "/tmp", "not allowed"},
+		{strings.Repeat("n", NAME_SIZE+1), "/tmp", "longer"},
+		{SPLIT_DIR_PREFIX + "00", "/tmp", "reserved"},
+		{"nopath", "", "no path"},
+	}
+	for _, tt := range tests {
+		err := AddShare(tt.name, tt.path)
+		switch {
+		case tt.problem == "" && err != nil:
+			t.Errorf("AddShare(%q) = %v", tt.name, err)
+		case tt.problem != "" && (err == nil || !strings.Contains(err.Error(), tt.problem)):
+			t.Errorf("AddShare(%q) = %v, want an error about %q", tt.name, err, tt.problem)
+		}
+	}
+	if len(Shares) != 2 {
+		t.Errorf("%d shares, want 2", len(Shares))
+	}
+}
+
+// Shares are published each under its name, with its own ignore files, rehashed and downloaded together
+func TestServeShares(t *testing.T) {
+	defer func(shares []Share) { Shares = shares }(Shares)
+	Shares = nil
+
+	zeta := writeShare(t, map[string][]byte{"x": []byte("x"), "skip.log": []byte("l"), IGNORE_FILE: []byte("*.log\n")})
+	alpha := writeShare(t, map[string][]byte{"sub/y.log": []byte("y")})
+	single := filepath.Join(writeShare(t, map[string][]byte{"single": testContent(5000)}), "single")
+	for _, s := range []Share{{"zeta", zeta}, {"alpha", alpha}, {"file", single}} {
+		if err := AddShare(s.Name, s.Path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := MerkelifyShares(Shares)
+
+	w := WatchShare(root)
+	defer w.Close()
+	if err := os.WriteFile(filepath.Join(alpha, "sub", "new"), []byte("n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case root = <-w.Changed():
+		if want := MerkelifyShares(Shares); !bytes.Equal(root.Hash, want.Hash) {
+			t.Fatalf("rehashed root %x, built %x", root.Hash, want.Hash)
+		}
+	case <-time.After(WATCH_POLL + 5*time.Second):
+		t.Fatal("change not seen")
+	}
+
+	want := writeShare(t, map[string][]byte{
+		"zeta/x":              []byte("x"),
+		"zeta/" + IGNORE_FILE: []byte("*.log\n"),
+		"alpha/sub/y.log":     []byte("y"),
+		"alpha/sub/new":       []byte("n"),
+		"file":                testContent(5000),
+	})
+	conn := serveTree(t, root)
+	out := t.TempDir()
+	obj := DataObject{Op: OP_DOWNLOAD_HASH, Type: NODE_UNKNOWN, HddPath: out}
+	if DownloadData(conn, root.Hash, "me", &obj) != RESULT_OK {
+		t.Fatal("download failed")
+	}
+	sameFiles(t, want, out)
+}
@@ -0,0 +1,308 @@
+package moduls
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Drop the messages that must be signed (see mustBeSigned) and are not, or whose signature can't be checked,
+// and every message with a wrong signature (set by "signatures=strict" in config).
+// Otherwise they are accepted, those with a wrong signature with a warning.
+var StrictSignatures = false
+
+// Fetch the key a peer announced to the server, by name (set by the client, see PeerKey).
+// It is checked against the key pinned for the peer (see PinPeerKey), which is kept if the fetch fails.
+// nil: keys of peers are not fetched, only the key of the server is known.
+var FetchPeerKey func(peer string) ([]byte, error)
+
+// A peer without a key, or whose key changed, is asked for it again after this
+const KEY_RETRY = time.Minute
+
+// Keys of peers fetched at the same time, and kept at most (the oldest is forgotten first)
+const (
+	MAX_KEY_FETCHES    = 4
+	MAX_PEER_KEYS      = 1024
+	MAX_PENDING_HELLOS = 4 // Hellos of a peer kept until its key is fetched
+)
+
+// Types of the messages the protocol requires to be signed by a sender that has a key
+func mustBeSigned(typeMes byte) bool {
+	switch typeMes {
+	case HELLO, HELLO_REPLY, PUBLIC_KEY, PUBLIC_KEY_REPLY, ROOT, ROOT_REPLY, SESSION_KEY, SESSION_KEY_REPLY:
+		return true
+	}
+	return false
+}
+
+// Types of the messages whose signature is checked when they carry one
+func checksSignature(typeMes byte) bool {
+	return mustBeSigned(typeMes) || typeMes == DATUM || typeMes == NO_DATUM
+}
+
+// Keys of the nodes we talk to: by address, learnt from Hello and HelloReply (or set for the server),
+// and by name of peer, as fetched from the server
+var keysMutex sync.Mutex
+var keysByAddr = map[string]*ecdsa.PublicKey{}
+var keysByName = map[string]*peerKey{}
+
+type peerKey struct {
+	key     *ecdsa.PublicKey // nil if the peer has none
+	err     error            // ErrKeyChanged if the key given by the server is not the pinned one
+	fetched time.Time        // zero while the key is being fetched
+	done    chan struct{}    // closed once it is fetched
+	pending []pendingHello   // received while it is fetched, checked once it is known
+}
+
+// Hello or HelloReply whose sender's key was not known yet
+type pendingHello struct {
+	m    *Message
+	from *net.UDPAddr
+}
+
+// One token per key being fetched
+var keyFetches = make(chan struct{}, MAX_KEY_FETCHES)
+
+// Bytes covered by the signature of m: its header and body
+func (m *Message) signedBytes() []byte {
+	unsigned := *m
+	unsigned.Signature = nil
+	data, _ := unsigned.MarshalBinary()
+	return data
+}
+
+// Sign m with our identity if its type must be signed and we have one
+func signMessage(m *Message) {
+	id := MyIdentity()
+	if id == nil || !mustBeSigned(m.Type) || len(m.Signature) != 0 {
+		return
+	}
+	signature, err := id.Sign(m.signedBytes())
+	if err != nil {
+		HandlePanicError(err, fmt.Sprintf("%s sent unsigned", TypeName(m.Type)))
+		return
+	}
+	m.Signature = signature
+}
+
+// Take key, carried by the PublicKey of the server, as the one of the node at addr.
+// A key already bound to addr, from a Hello of the server checked against the key fetched for its name, is kept.
+// Return: ErrKeyChanged if key is not the one bound to addr
+func setAddrKey(addr net.Addr, key []byte) error {
+	if addr == nil || len(key) != KEY_SIZE {
+		return nil
+	}
+	k := ParcePublicKay(key)
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	if bound := keysByAddr[addr.String()]; bound != nil {
+		if !bound.Equal(&k) {
+			return fmt.Errorf("%s: %w", addr, ErrKeyChanged)
+		}
+		return nil
+	}
+	keysByAddr[addr.String()] = &k
+	return nil
+}
+
+// Key of the peer named name, as fetched from the server (see fetchNameKey).
+// Called from the receive loops, so it never waits: a key not fetched yet is unknown until its fetch is over.
+// hello (if not nil) is then kept, and bound to its address if its signature matches the key fetched.
+// Return: the key pinned for it, and ErrKeyChanged if the server gave another one
+func nameKey(name string, hello *pendingHello) (*ecdsa.PublicKey, error) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	known := keysByName[name]
+	switch {
+	case known != nil && known.fetched.IsZero():
+		if hello != nil && len(known.pending) < MAX_PENDING_HELLOS {
+			known.pending = append(known.pending, *hello)
+		}
+		return nil, nil
+	case known != nil && ((known.key != nil && known.err == nil) || time.Since(known.fetched) < KEY_RETRY):
+		return known.key, known.err
+	case FetchPeerKey == nil:
+		return nil, nil
+	}
+
+	select {
+	case keyFetches <- struct{}{}:
+	default:
+		// too many fetches running: the next message of the peer will try again
+		if known != nil {
+			return known.key, known.err
+		}
+		return nil, nil
+	}
+	if known == nil && len(keysByName) >= MAX_PEER_KEYS {
+		forgetOldestPeerKey()
+	}
+	k := &peerKey{done: make(chan struct{})}
+	if hello != nil {
+		k.pending = []pendingHello{*hello}
+	}
+	keysByName[name] = k
+	go fetchNameKey(name, k)
+	return nil, nil
+}
+
+// Fetch the key of peer name from the server and pin it (or take the pinned one if the server can't be asked), then bind it to the address of the Hellos that wait for it
+func fetchNameKey(name string, k *peerKey) {
+	defer func() { <-keyFetches }()
+	key, err := FetchPeerKey(name)
+	if err == nil {
+		key, err = PinPeerKey(name, key)
+	} else {
+		// the server didn't answer: the key pinned for the peer still holds
+		UnexpectedMessage(fmt.Sprintf("Key of peer %s: %v", name, err))
+		key, err = PinnedPeerKey(name)
+	}
+
+	keysMutex.Lock()
+	if len(key) == KEY_SIZE {
+		public := ParcePublicKay(key)
+		k.key = &public
+	}
+	k.err = err
+	k.fetched = time.Now()
+	if k.key != nil && k.err == nil {
+		for _, h := range k.pending {
+			if h.from != nil && len(h.m.Signature) != 0 && CheckSignature(h.m.signedBytes(), h.m.Signature, k.key) {
+				keysByAddr[h.from.String()] = k.key
+			}
+		}
+	}
+	k.pending = nil
+	keysMutex.Unlock()
+	close(k.done)
+}
+
+// Make room in keysByName, keysMutex held: forget the key fetched the longest time ago
+func forgetOldestPeerKey() {
+	oldest := ""
+	for name, k := range keysByName {
+		if k.fetched.IsZero() {
+			continue
+		}
+		if oldest == "" || k.fetched.Before(keysByName[oldest].fetched) {
+			oldest = name
+		}
+	}
+	if oldest != "" {
+		delete(keysByName, oldest)
+	}
+}
+
+// Forget what was fetched for peer, and the addresses its key was bound to,
+// so that a key trusted or forgotten in known_peers applies from its next Hello on
+func forgetCachedPeerKey(peer string) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	k := keysByName[peer]
+	if k == nil {
+		return
+	}
+	delete(keysByName, peer)
+	if k.key == nil {
+		return
+	}
+	for addr, key := range keysByAddr {
+		if key.Equal(k.key) {
+			delete(keysByAddr, addr)
+		}
+	}
+}
+
+// Bind to from the key of the sender of Hello or HelloReply m, waiting for it to be fetched if needed.
+// Unlike nameKey it may wait for the server: for the callers that greet a peer, not for the receive loops.
+func awaitSenderKey(m *Message, from *net.UDPAddr) {
+	_, name, err := m.Hello()
+	if err != nil || from == nil {
+		return
+	}
+	nameKey(name, nil)
+	keysMutex.Lock()
+	k := keysByName[name]
+	keysMutex.Unlock()
+	if k == nil {
+		return
+	}
+	<-k.done
+	if k.key != nil && k.err == nil && len(m.Signature) != 0 && CheckSignature(m.signedBytes(), m.Signature, k.key) {
+		keysMutex.Lock()
+		keysByAddr[from.String()] = k.key
+		keysMutex.Unlock()
+	}
+}
+
+// Key m should be signed with, nil if unknown.
+// A Hello or HelloReply names its sender: its key is then the one of the node at from for the messages that follow.
+// Return: ErrKeyChanged if the sender is a peer whose key changed
+func senderKey(m *Message, from *net.UDPAddr) (*ecdsa.PublicKey, error) {
+	addr := ""
+	if from != nil {
+		addr = from.String()
+	}
+	keysMutex.Lock()
+	key := keysByAddr[addr]
+	keysMutex.Unlock()
+
+	switch m.Type {
+	case HELLO, HELLO_REPLY:
+		if key != nil {
+			return key, nil // the server, or a peer already greeted
+		}
+		_, name, _ := m.Hello()
+		var err error
+		key, err = nameKey(name, &pendingHello{m, from})
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && from != nil && len(m.Signature) != 0 && CheckSignature(m.signedBytes(), m.Signature, key) {
+			keysMutex.Lock()
+			keysByAddr[addr] = key
+			keysMutex.Unlock()
+		}
+	}
+	// any other message, PublicKey included, is checked against the key bound to its address:
+	// the key a PublicKey carries proves nothing about its sender, anyone can sign with its own key
+	return key, nil
+}
+
+// Check the signature of m, received from from, following StrictSignatures.
+// Hello and HelloReply of a peer whose key changed are always refused, signed or not.
+// Return: a *MessageError if m must be dropped
+func verifyMessage(m *Message, from *net.UDPAddr) error {
+	if !checksSignature(m.Type) {
+		return nil
+	}
+	key, err := senderKey(m, from)
+	if err != nil {
+		return &MessageError{m.Type, err, fmt.Sprintf("from %s", from)}
+	}
+
+	required := StrictSignatures && mustBeSigned(m.Type)
+	if len(m.Signature) == 0 {
+		if required {
+			return &MessageError{m.Type, ErrUnsigned, fmt.Sprintf("from %s", from)}
+		}
+		return nil
+	}
+	if key == nil {
+		if required {
+			return &MessageError{m.Type, ErrUnknownKey, fmt.Sprintf("from %s", from)}
+		}
+		return nil
+	}
+	if !CheckSignature(m.signedBytes(), m.Signature, key) {
+		err := &MessageError{m.Type, ErrWrongSignature, fmt.Sprintf("from %s", from)}
+		if StrictSignatures {
+			return err
+		}
+		UnexpectedMessage(fmt.Sprintf("Warning: %v, accepted", err))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package moduls
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"net"
+	"testing"
+)
+
+// Fetch the key of peer name as a Hello from it would, and wait for the fetch to end
+func fetchKey(name string) {
+	nameKey(name, nil)
+	keysMutex.Lock()
+	k := keysByName[name]
+	keysMutex.Unlock()
+	if k != nil {
+		<-k.done
+	}
+}
+
+// Messages of the types that must be signed carry a signature of their header and body, the others don't
+func TestSignMessage(t *testing.T) {
+	defer UseIdentity(MyIdentity())
+	id, _ := NewIdentity()
+	UseIdentity(id)
+	key := ParcePublicKay(id.PublicKey())
+
+	tests := []struct {
+		m      *Message
+		signed bool
+	}{
+		{NewHelloMessage(1, HELLO, 0, "me"), true},
+		{NewHelloMessage(1, HELLO_REPLY, 0, "me"), true},
+		{NewPublicKeyMessage(1, PUBLIC_KEY_REPLY, id.PublicKey()), true},
+		{NewHashMessage(1, ROOT, make([]byte, HASH_SIZE)), true},
+		{NewHashMessage(1, GET_DATUM, make([]byte, HASH_SIZE)), false},
+		{NewHashMessage(1, NO_DATUM, make([]byte, HASH_SIZE)), false},
+	}
+	for _, tt := range tests {
+		signMessage(tt.m)
+		switch {
+		case !tt.signed && tt.m.Signature != nil:
+			t.Errorf("%s signed", TypeName(tt.m.Type))
+		case tt.signed && len(tt.m.Signature) != SIGN_SIZE:
+			t.Errorf("%s: signature of %d bytes", TypeName(tt.m.Type), len(tt.m.Signature))
+		case tt.signed && !CheckSignature(tt.m.signedBytes(), tt.m.Signature, &key):
+			t.Errorf("%s: signature does not check", TypeName(tt.m.Type))
+		}
+	}
+}
+
+// A Hello is accepted or dropped depending on its signature, the key the server gives for its sender and StrictSignatures
+func TestVerifyMessage(t *testing.T) {
+	defer func(id *Identity, fetch func(string) ([]byte, error), strict bool) {
+		UseIdentity(id)
+		FetchPeerKey, StrictSignatures = fetch, strict
+		keysByAddr, keysByName = map[string]*ecdsa.PublicKey{}, map[string]*peerKey{}
+	}(MyIdentity(), FetchPeerKey, StrictSignatures)
+	peer, _ := NewIdentity()
+	other, _ := NewIdentity()
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+
+	tests := []struct {
+		name   string
+		signer *Identity // nil: unsigned
+		known  *Identity // key the server gives for the peer, nil: none
+		strict bool
+		err    error
+	}{
+		{"signed", peer, peer, true, nil},
+		{"unsigned", nil, peer, false, nil},
+		{"unsigned, strict", nil, peer, true, ErrUnsigned},
+		{"key unknown", peer, nil, false, nil},
+		{"key unknown, strict", peer, nil, true, ErrUnknownKey},
+		{"wrong key", other, peer, false, nil},
+		{"wrong key, strict", other, peer, true, ErrWrongSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keysByAddr, keysByName = map[string]*ecdsa.PublicKey{}, map[string]*peerKey{}
+			FetchPeerKey = func(name string) ([]byte, error) {
+				if tt.known == nil || name != "peer" {
+					return nil, nil // known to the server, without a key
+				}
+				return tt.known.PublicKey(), nil
+			}
+			StrictSignatures = tt.strict
+			fetchKey("peer")
+			m := NewHelloMessage(1, HELLO, 0, "peer")
+			if tt.signer != nil {
+				UseIdentity(tt.signer)
+				signMessage(m)
+			}
+			if err := verifyMessage(m, from); !errors.Is(err, tt.err) {
+				t.Errorf("verifyMessage = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// the first Hello waits for the key of its sender, which is then bound to its address
+	keysByAddr, keysByName = map[string]*ecdsa.PublicKey{}, map[string]*peerKey{}
+	FetchPeerKey = func(string) ([]byte, error) { return peer.PublicKey(), nil }
+	StrictSignatures = true
+	UseIdentity(peer)
+	hello := NewHelloMessage(1, HELLO, 0, "peer")
+	signMessage(hello)
+	if err := verifyMessage(hello, from); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Hello before the key is fetched: %v, want %v", err, ErrUnknownKey)
+	}
+	fetchKey("peer")
+	keysMutex.Lock()
+	bound := keysByAddr[from.String()]
+	keysMutex.Unlock()
+	if bound == nil {
+		t.Fatal("key of the peer not bound to the address of its Hello")
+	}
+	FetchPeerKey = nil
+	forged := NewHashMessage(2, ROOT, make([]byte, HASH_SIZE))
+	UseIdentity(other)
+	signMessage(forged)
+	if err := verifyMessage(forged, from); !errors.Is(err, ErrWrongSignature) {
+		t.Errorf("Root signed by another key: %v, want %v", err, ErrWrongSignature)
+	}
+}
+
+// A PublicKey signed by the key it carries proves nothing: it is checked against the key bound to its sender
+func TestVerifyPublicKey(t *testing.T) {
+	defer func(id *Identity, strict bool) {
+		UseIdentity(id)
+		StrictSignatures = strict
+		keysByAddr = map[string]*ecdsa.PublicKey{}
+	}(MyIdentity(), StrictSignatures)
+	StrictSignatures = true
+	server, _ := NewIdentity()
+	impostor, _ := NewIdentity()
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+
+	UseIdentity(impostor)
+	m := NewPublicKeyMessage(1, PUBLIC_KEY_REPLY, impostor.PublicKey())
+	signMessage(m)
+
+	keysByAddr = map[string]*ecdsa.PublicKey{}
+	if err := verifyMessage(m, from); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("no key bound: %v, want %v", err, ErrUnknownKey)
+	}
+	setAddrKey(from, server.PublicKey())
+	if err := verifyMessage(m, from); !errors.Is(err, ErrWrongSignature) {
+		t.Errorf("other key bound: %v, want %v", err, ErrWrongSignature)
+	}
+	if err := setAddrKey(from, impostor.PublicKey()); !errors.Is(err, ErrKeyChanged) {
+		t.Errorf("key bound replaced: %v, want %v", err, ErrKeyChanged)
+	}
+}
@@ -0,0 +1,322 @@
+package moduls
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// how often the reader wakes up to check if the table was closed
+const READ_POLL = 100 * time.Millisecond
+
+// Table of the requests in flight on one UDP connection.
+// A single goroutine reads the connection and routes every reply to the request waiting for its Id,
+// so any number of requests can be outstanding at once.
+// The connection may be unconnected: requests then name their peer, whose replies only are accepted.
+type Transactions struct {
+	conn    *net.UDPConn
+	rtt     *RttEstimator // of the remote peer if conn is connected, drives retransmissions
+	mutex   sync.Mutex
+	nextId  uint32
+	pending map[uint32]*pendingRequest
+	closed  chan struct{}
+	done    chan struct{}
+
+	unsolicited func(m *Message, remoteAddr *net.UDPAddr) // handler of messages that are not replies, may be nil
+	dropped     int                                       // replies discarded because they were duplicated, late or unknown
+}
+
+type pendingRequest struct {
+	to       *net.UDPAddr // nil if conn is connected
+	deadline time.Time
+	reply    chan *Message // buffered, receives exactly one reply
+}
+
+var transactionsMutex sync.Mutex
+var transactions = map[*net.UDPConn]*Transactions{}
+
+// Get the transaction table of connection, creating it at first use.
+// From then on the table owns the reading side of conn.
+func GetTransactions(conn *net.UDPConn) *Transactions {
+	transactionsMutex.Lock()
+	defer transactionsMutex.Unlock()
+
+	t, ok := transactions[conn]
+	if !ok {
+		t = NewTransactions(conn)
+		transactions[conn] = t
+	}
+	return t
+}
+
+// Transaction table of connection, nil if it has none
+func transactionsOf(conn *net.UDPConn) *Transactions {
+	transactionsMutex.Lock()
+	defer transactionsMutex.Unlock()
+	return transactions[conn]
+}
+
+// Stop the transaction table of connection, if there is one
+func CloseTransactions(conn *net.UDPConn) {
+	transactionsMutex.Lock()
+	t, ok := transactions[conn]
+	delete(transactions, conn)
+	transactionsMutex.Unlock()
+
+	if ok {
+		t.Close()
+	}
+}
+
+// Create transaction table and start reading conn
+func NewTransactions(conn *net.UDPConn) *Transactions {
+	t := &Transactions{
+		conn:    conn,
+		rtt:     PeerRtt(conn.RemoteAddr()),
+		nextId:  rand.Uint32(),
+		pending: map[uint32]*pendingRequest{},
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go t.readLoop()
+	return t
+}
+
+// Stop reading; requests still waiting fail with ErrClosed
+func (t *Transactions) Close() {
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+	}
+	<-t.done
+}
+
+// Set handler of incoming messages that are not replies (requests of the remote peer).
+// It is called from the reader goroutine, so it must not block for long.
+func (t *Transactions) SetUnsolicited(handler func(m *Message, remoteAddr *net.UDPAddr)) {
+	t.mutex.Lock()
+	t.unsolicited = handler
+	t.mutex.Unlock()
+}
+
+// Send request to remoteAddr (nil if conn is connected) and wait for its reply.
+// The Id of request is allocated here (any value set by the caller is overwritten).
+// The request is re-sent after the retransmission timeout of the peer, doubled at each loss,
+// until a reply arrives or timeout expires.
+// Return: the reply, whatever its type, or ErrTimeout / ErrClosed / a network error
+func (t *Transactions) Request(remoteAddr *net.UDPAddr, request *Message, timeout time.Duration) (*Message, error) {
+	return t.RequestWithLoss(remoteAddr, request, timeout, nil)
+}
+
+// Same as Request, calling onLoss (if not nil) each time a transmission of request times out
+func (t *Transactions) RequestWithLoss(remoteAddr *net.UDPAddr, request *Message, timeout time.Duration, onLoss func()) (*Message, error) {
+	rtt := t.rtt
+	if remoteAddr != nil {
+		rtt = PeerRtt(remoteAddr)
+	}
+	deadline := time.Now().Add(timeout)
+	p := &pendingRequest{to: remoteAddr, deadline: deadline, reply: make(chan *Message, 1)}
+
+	t.mutex.Lock()
+	for {
+		t.nextId++
+		if _, busy := t.pending[t.nextId]; !busy {
+			break
+		}
+	}
+	request.Id = t.nextId
+	t.pending[request.Id] = p
+	t.mutex.Unlock()
+
+	defer t.forget(request.Id)
+
+	expire := time.NewTimer(timeout)
+	defer expire.Stop()
+
+	sent := 0
+	var sentAt time.Time
+	for {
+		if err := writeMessage(t.conn, remoteAddr, request); err != nil {
+			return nil, err
+		}
+		sent++
+		if sent == 1 {
+			sentAt = time.Now()
+		}
+
+		armed := rtt.Timeout()
+		retransmit := time.NewTimer(armed)
+		select {
+		case reply := <-p.reply:
+			retransmit.Stop()
+			if sent == 1 { // Karn's algorithm: no measure on retransmitted requests
+				rtt.Sample(time.Since(sentAt))
+			}
+			return reply, nil
+		case <-retransmit.C:
+			rtt.Backoff(armed)
+			if onLoss != nil {
+				onLoss()
+			}
+			if LOG_PRINT_DATA {
+				PrintError(fmt.Sprintf("Request %s %d: timeout %v, resend\n", TypeName(request.Type), request.Id, armed))
+			}
+		case <-expire.C:
+			retransmit.Stop()
+			return nil, ErrTimeout
+		case <-t.closed:
+			retransmit.Stop()
+			return nil, ErrClosed
+		}
+	}
+}
+
+func (t *Transactions) forget(id uint32) {
+	t.mutex.Lock()
+	delete(t.pending, id)
+	t.mutex.Unlock()
+}
+
+// Route incoming replies to their requests until Close
+func (t *Transactions) readLoop() {
+	defer close(t.done)
+	buf := make([]byte, DATAGRAM_SIZE)
+
+	for {
+		select {
+		case <-t.closed:
+			return
+		default:
+		}
+
+		t.conn.SetReadDeadline(time.Now().Add(READ_POLL))
+		m, remoteAddr, err := readMessage(t.conn, buf)
+		if err != nil {
+			var e net.Error
+			if errors.As(err, &e) && e.Timeout() {
+				continue
+			}
+			if _, ok := err.(*MessageError); ok {
+				UnexpectedMessage(fmt.Sprintf("Transactions: malformed message from %s dropped: %v", remoteAddr, err))
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			HandlePanicError(err, "Transactions: ReadFromUDP")
+			continue
+		}
+
+		if !isReply(m.Type) {
+			t.mutex.Lock()
+			handler := t.unsolicited
+			t.mutex.Unlock()
+			if handler != nil {
+				handler(m, remoteAddr)
+			}
+			continue
+		}
+		t.deliver(m, remoteAddr)
+	}
+}
+
+// Hand reply, received from from, to the request waiting for it, drop it if nobody waits anymore
+func (t *Transactions) deliver(m *Message, from *net.UDPAddr) {
+	t.mutex.Lock()
+	p, ok := t.pending[m.Id]
+	if ok && !sameAddr(p.to, from) {
+		ok = false // the request was sent to another peer
+	} else if ok && time.Now().After(p.deadline) {
+		ok = false // the waiting request is about to fail with ErrTimeout
+	}
+	if ok {
+		delete(t.pending, m.Id)
+	} else {
+		t.dropped++
+	}
+	t.mutex.Unlock()
+
+	if !ok {
+		if LOG_PRINT_DATA {
+			UnexpectedMessage(fmt.Sprintf("Transactions: late or duplicated %s %d dropped", TypeName(m.Type), m.Id))
+		}
+		return
+	}
+	p.reply <- m
+}
+
+// Replies have the high bit of type set
+func isReply(typeMes byte) bool {
+	return typeMes >= 128
+}
+
+// Send request on a connection that is read directly (without transaction table) and wait for the reply with the same Id.
+// The request is re-sent after the retransmission timeout of the peer, doubled at each loss, until timeout expires.
+// Other messages received meanwhile are dropped.
+// remoteAddr is nil if conn is connected to the peer, otherwise messages from other addresses are dropped too.
+// If conn has a transaction table (see GetTransactions), the request goes through it instead,
+// and the requests received meanwhile reach its handler (see ServeIncoming).
+// Return: the reply, whatever its type, or ErrTimeout / a network error
+func exchange(conn *net.UDPConn, remoteAddr *net.UDPAddr, request *Message, timeout time.Duration) (*Message, error) {
+	if t := transactionsOf(conn); t != nil {
+		return t.Request(remoteAddr, request, timeout)
+	}
+	var rtt *RttEstimator
+	if remoteAddr == nil {
+		rtt = PeerRtt(conn.RemoteAddr())
+	} else {
+		rtt = PeerRtt(remoteAddr)
+	}
+	buf := make([]byte, DATAGRAM_SIZE)
+	deadline := time.Now().Add(timeout)
+
+	sent := 0
+	var sentAt time.Time
+	for time.Now().Before(deadline) {
+		if err := writeMessage(conn, remoteAddr, request); err != nil {
+			return nil, err
+		}
+		sent++
+		if sent == 1 {
+			sentAt = time.Now()
+		}
+
+		armed := rtt.Timeout()
+		retransmitAt := time.Now().Add(armed)
+		if retransmitAt.After(deadline) {
+			retransmitAt = deadline
+		}
+
+		for {
+			conn.SetReadDeadline(retransmitAt)
+			m, from, err := readMessage(conn, buf)
+			if err != nil {
+				var e net.Error
+				if errors.As(err, &e) && e.Timeout() {
+					rtt.Backoff(armed)
+					break
+				}
+				if _, ok := err.(*MessageError); ok {
+					UnexpectedMessage(fmt.Sprintf("%s: malformed message from %s dropped: %v", TypeName(request.Type), from, err))
+					continue
+				}
+				return nil, err
+			}
+			if m.Id != request.Id || !isReply(m.Type) || !sameAddr(remoteAddr, from) {
+				if LOG_PRINT_DATA {
+					UnexpectedMessage(fmt.Sprintf("%s %d: %s %d dropped", TypeName(request.Type), request.Id, TypeName(m.Type), m.Id))
+				}
+				continue
+			}
+			if sent == 1 { // Karn's algorithm: no measure on retransmitted requests
+				rtt.Sample(time.Since(sentAt))
+			}
+			return m, nil
+		}
+	}
+	return nil, ErrTimeout
+}
@@ -0,0 +1,116 @@
+package moduls
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Replies discarded by t so far
+func droppedBy(t *Transactions) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.dropped
+}
+
+// Requests sent at once get their own reply, whatever the order replies come back in
+func TestTransactionsMatchById(t *testing.T) {
+	const count = 8
+	peer, conn := loopbackPair(t)
+
+	// the peer holds the requests until it has them all, then answers the last one first
+	var held []*Message
+	var mutex sync.Mutex
+	answerWith(peer, func(m *Message) *Message {
+		mutex.Lock()
+		defer mutex.Unlock()
+		held = append(held, m)
+		if len(held) < count {
+			return nil
+		}
+		for i := len(held) - 1; i > 0; i-- {
+			writeMessage(peer, conn.LocalAddr().(*net.UDPAddr), NewHashMessage(held[i].Id, NO_DATUM, held[i].Body))
+		}
+		return NewHashMessage(held[0].Id, NO_DATUM, held[0].Body)
+	})
+
+	tr := NewTransactions(conn)
+	defer tr.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(hash []byte) {
+			defer wg.Done()
+			reply, err := tr.Request(nil, NewHashMessage(0, GET_DATUM, hash), 5*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(reply.Body, hash) {
+				t.Errorf("request for %x got the reply for %x", hash[0], reply.Body[0])
+			}
+		}(bytes.Repeat([]byte{byte(i)}, HASH_SIZE))
+	}
+	wg.Wait()
+	if n := droppedBy(tr); n != 0 {
+		t.Errorf("%d replies dropped", n)
+	}
+}
+
+// A reply that comes twice, or after its request gave up, is dropped
+func TestTransactionsDropExtraReplies(t *testing.T) {
+	const (
+		twice = iota + 1
+		late
+	)
+	peer, conn := loopbackPair(t)
+	seen := map[uint32]bool{}
+	answerWith(peer, func(m *Message) *Message {
+		if seen[m.Id] {
+			return nil // retransmission
+		}
+		seen[m.Id] = true
+		reply := NewHashMessage(m.Id, NO_DATUM, m.Body)
+		switch m.Body[0] {
+		case twice:
+			writeMessage(peer, conn.LocalAddr().(*net.UDPAddr), reply)
+		case late:
+			time.Sleep(300 * time.Millisecond)
+		}
+		return reply
+	})
+
+	tr := NewTransactions(conn)
+	defer tr.Close()
+	tests := []struct {
+		name    string
+		kind    byte
+		timeout time.Duration
+		err     error
+	}{
+		{"reply sent twice", twice, 5 * time.Second, nil},
+		{"reply after the deadline", late, 100 * time.Millisecond, ErrTimeout},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := bytes.Repeat([]byte{tt.kind}, HASH_SIZE)
+			reply, err := tr.Request(nil, NewHashMessage(0, GET_DATUM, hash), tt.timeout)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Request = %v, want %v", err, tt.err)
+			}
+			if err == nil && !bytes.Equal(reply.Body, hash) {
+				t.Errorf("got the reply for %x", reply.Body[0])
+			}
+			// the extra reply reaches the table after the request returned
+			for wait := time.Now().Add(time.Second); droppedBy(tr) <= i && time.Now().Before(wait); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := droppedBy(tr); n != i+1 {
+				t.Errorf("%d replies dropped, want %d", n, i+1)
+			}
+		})
+	}
+}
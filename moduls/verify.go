@@ -0,0 +1,129 @@
+package moduls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// Where a node sits in the tree, which restricts the types it may have
+const (
+	POSITION_ROOT      = 0 // root of a download: any type
+	POSITION_DIR_ENTRY = 1 // entry of a directory: any type
+	POSITION_FILE_PART = 2 // child of a BIG_FILE: CHUNK or BIG_FILE only
+	POSITION_DIR_PART  = 3 // part of a split directory (see SPLIT_DIR_PREFIX): DIRECTORY only
+)
+
+// Limits of the tree given by the protocol
+const (
+	MIN_BIG_FILE_CHILDREN = 2
+	MAX_BIG_FILE_CHILDREN = MAX_CHILDREN
+	MAX_DIR_ENTRIES       = 16
+	DIR_ENTRY_SIZE        = NAME_SIZE + HASH_SIZE
+)
+
+// Check that value (already known to match its hash) is a well formed node for its position.
+// Return: nil, or a description of what is wrong
+func VerifyNode(value []byte, position int) error {
+	if len(value) == 0 {
+		return fmt.Errorf("empty value")
+	}
+	body := value[1:]
+
+	if position == POSITION_DIR_PART && value[0] != DIRECTORY {
+		return fmt.Errorf("part of a split directory of type %d", value[0])
+	}
+
+	switch value[0] {
+	case CHUNK:
+		if len(body) > CHUNK_SIZE {
+			return fmt.Errorf("chunk of %d bytes, more than %d", len(body), CHUNK_SIZE)
+		}
+
+	case BIG_FILE:
+		if len(body)%HASH_SIZE != 0 {
+			return fmt.Errorf("big file of %d bytes, not a list of hashes", len(body))
+		}
+		n := len(body) / HASH_SIZE
+		if n < MIN_BIG_FILE_CHILDREN || n > MAX_BIG_FILE_CHILDREN {
+			return fmt.Errorf("big file with %d children, not between %d and %d", n, MIN_BIG_FILE_CHILDREN, MAX_BIG_FILE_CHILDREN)
+		}
+
+	case DIRECTORY:
+		if position == POSITION_FILE_PART {
+			return fmt.Errorf("directory inside a big file")
+		}
+		if len(body)%DIR_ENTRY_SIZE != 0 {
+			return fmt.Errorf("directory of %d bytes, not a list of entries", len(body))
+		}
+		n := len(body) / DIR_ENTRY_SIZE
+		if n > MAX_DIR_ENTRIES {
+			return fmt.Errorf("directory with %d entries, more than %d", n, MAX_DIR_ENTRIES)
+		}
+		names := map[string]bool{}
+		for i := 0; i < n; i++ {
+			name, err := verifyName(body[i*DIR_ENTRY_SIZE : i*DIR_ENTRY_SIZE+NAME_SIZE])
+			if err != nil {
+				return fmt.Errorf("entry %d: %w", i, err)
+			}
+			if names[name] {
+				return fmt.Errorf("entry %d: name %q appears twice", i, name)
+			}
+			names[name] = true
+		}
+
+	default:
+		return fmt.Errorf("unknown type of node %d", value[0])
+	}
+	return nil
+}
+
+// Check name field of directory entry: UTF-8 name padded with NUL bytes
+// Return: the name without padding
+func verifyName(field []byte) (string, error) {
+	name := bytes.TrimRight(field, "\x00")
+	switch {
+	case len(name) == 0:
+		return "", fmt.Errorf("empty name")
+	case bytes.IndexByte(name, 0) >= 0:
+		return "", fmt.Errorf("name %q contains NUL", name)
+	case bytes.IndexByte(name, '/') >= 0:
+		return "", fmt.Errorf("name %q contains '/'", name)
+	case string(name) == "." || string(name) == "..":
+		return "", fmt.Errorf("name %q is not allowed", name)
+	case !utf8.Valid(name):
+		return "", fmt.Errorf("name %q is not UTF-8", name)
+	}
+	return string(name), nil
+}
+
+// Check that file on disk is exactly the concatenation of the chunks its BIG_FILE promised
+// Parameters:
+// - path - file written by the download
+// - leaves - hashes of the chunks, in file order
+// - lengths - sizes of the chunks, in file order
+func VerifyAssembledFile(path string, leaves [][]byte, lengths []int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	chunk := make([]byte, 1+CHUNK_SIZE)
+	for i, hash := range leaves {
+		chunk[0] = CHUNK
+		if _, err := io.ReadFull(file, chunk[1:1+lengths[i]]); err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+		if sum := sha256.Sum256(chunk[:1+lengths[i]]); !bytes.Equal(sum[:], hash) {
+			return fmt.Errorf("chunk %d does not match its hash on disk", i)
+		}
+	}
+	if n, _ := file.Read(chunk); n != 0 {
+		return fmt.Errorf("file is longer than its chunks")
+	}
+	return nil
+}
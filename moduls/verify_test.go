@@ -0,0 +1,145 @@
+package moduls
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Value of a directory node with entries of the given names
+func dirValue(names ...string) []byte {
+	value := []byte{DIRECTORY}
+	for _, name := range names {
+		entry := make([]byte, DIR_ENTRY_SIZE)
+		copy(entry, name)
+		value = append(value, entry...)
+	}
+	return value
+}
+
+// Value of a big file node with n children
+func bigFileValueOf(n int) []byte {
+	return append([]byte{BIG_FILE}, make([]byte, n*HASH_SIZE)...)
+}
+
+func TestVerifyNode(t *testing.T) {
+	many := make([]string, MAX_DIR_ENTRIES+1)
+	for i := range many {
+		many[i] = string(rune('a' + i))
+	}
+	tests := []struct {
+		name     string
+		value    []byte
+		position int
+		err      string // part of the error, "" if the node is accepted
+	}{
+		{"empty value", nil, POSITION_ROOT, "empty value"},
+		{"unknown type", []byte{7}, POSITION_ROOT, "unknown type"},
+
+		{"empty chunk", []byte{CHUNK}, POSITION_ROOT, ""},
+		{"full chunk", append([]byte{CHUNK}, make([]byte, CHUNK_SIZE)...), POSITION_FILE_PART, ""},
+		{"chunk too long", append([]byte{CHUNK}, make([]byte, CHUNK_SIZE+1)...), POSITION_ROOT, "more than"},
+		{"chunk as part of a directory", []byte{CHUNK, 1}, POSITION_DIR_PART, "part of a split directory"},
+
+		{"big file of 2", bigFileValueOf(MIN_BIG_FILE_CHILDREN), POSITION_DIR_ENTRY, ""},
+		{"big file of 32", bigFileValueOf(MAX_BIG_FILE_CHILDREN), POSITION_FILE_PART, ""},
+		{"big file of 1", bigFileValueOf(1), POSITION_ROOT, "children"},
+		{"big file of 33", bigFileValueOf(MAX_BIG_FILE_CHILDREN + 1), POSITION_ROOT, "children"},
+		{"big file cut in a hash", bigFileValueOf(2)[:2*HASH_SIZE], POSITION_ROOT, "not a list of hashes"},
+
+		{"empty directory", dirValue(), POSITION_ROOT, ""},
+		{"directory of 16", dirValue(many[:MAX_DIR_ENTRIES]...), POSITION_DIR_PART, ""},
+		{"directory of 17", dirValue(many...), POSITION_ROOT, "more than"},
+		{"directory inside a big file", dirValue("a"), POSITION_FILE_PART, "inside a big file"},
+		{"directory cut in an entry", dirValue("a")[:DIR_ENTRY_SIZE], POSITION_ROOT, "not a list of entries"},
+		{"name of 32 bytes", dirValue(strings.Repeat("n", NAME_SIZE)), POSITION_ROOT, ""},
+		{"utf-8 name", dirValue("été.txt"), POSITION_ROOT, ""},
+		{"empty name", dirValue(""), POSITION_ROOT, "empty name"},
+		{"name with NUL inside", dirValue("a\x00b"), POSITION_ROOT, "contains NUL"},
+		{"name with a slash", dirValue("../etc"), POSITION_ROOT, "contains '/'"},
+		{"dot", dirValue("."), POSITION_ROOT, "not allowed"},
+		{"dot dot", dirValue(".."), POSITION_ROOT, "not allowed"},
+		{"name not utf-8", dirValue("\xff\xfe"), POSITION_ROOT, "not UTF-8"},
+		{"same name twice", dirValue("a", "b", "a"), POSITION_ROOT, "appears twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyNode(tt.value, tt.position)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("refused: %v", err)
+			case tt.err != "" && err == nil:
+				t.Errorf("accepted, want an error with %q", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("error %q, want one with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyAssembledFile(t *testing.T) {
+	data := testContent(2*CHUNK_SIZE + 10)
+	var leaves [][]byte
+	var lengths []int
+	for off := 0; off < len(data); off += CHUNK_SIZE {
+		end := off + CHUNK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, datumStore{}.add(append([]byte{CHUNK}, data[off:end]...)))
+		lengths = append(lengths, end-off)
+	}
+	changed := append([]byte(nil), data...)
+	changed[CHUNK_SIZE+5] ^= 1
+
+	tests := []struct {
+		name    string
+		content []byte
+		ok      bool
+	}{
+		{"same content", data, true},
+		{"byte changed", changed, false},
+		{"shorter", data[:len(data)-1], false},
+		{"longer", append(append([]byte(nil), data...), 0), false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f")
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := VerifyAssembledFile(path, leaves, lengths)
+			if (err == nil) != tt.ok {
+				t.Errorf("VerifyAssembledFile = %v", err)
+			}
+		})
+	}
+}
+
+// A download stops at the first malformed node a peer sends
+func TestDownloadRefusesMalformedTree(t *testing.T) {
+	store := datumStore{}
+	chunk := store.file([]byte("content"))
+	tests := []struct {
+		name string
+		root []byte
+	}{
+		{"big file of one chunk", store.add(append([]byte{BIG_FILE}, chunk...))},
+		{"same name twice", store.dir(testEntry{"a", chunk}, testEntry{"a", chunk})},
+		{"directory inside a big file", store.add(append(append([]byte{BIG_FILE}, chunk...), store.dir(testEntry{"a", chunk})...))},
+	}
+	peer, conn := loopbackPair(t)
+	answerWith(peer, store.reply)
+	defer CloseTransactions(conn)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			obj := DataObject{Op: OP_DOWNLOAD_HASH, Type: NODE_UNKNOWN, HddPath: out}
+			if DownloadData(conn, tt.root, "me", &obj) != RESULT_ERROR {
+				t.Error("malformed tree downloaded")
+			}
+		})
+	}
+}
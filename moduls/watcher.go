@@ -0,0 +1,355 @@
+package moduls
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WATCH_DELAY = 500 * time.Millisecond // quiet time after the last change before rehashing
+	WATCH_POLL  = 2 * time.Second        // period of the scan of the share when inotify can't be used
+)
+
+// Keeps the tree of a share, or of several (see MerkelifyShares), up to date with the files on disk.
+// Changes are reported by inotify, or found by scanning the share periodically when inotify is not available.
+// Once they settle, only the changed paths are hashed again (see Rehash), the new tree is served
+// and sent on Changed so it can be announced to the server.
+type ShareWatcher struct {
+	paths   []string // of the shares watched
+	root    Node     // only used by run
+	changed chan Node
+
+	mutex sync.Mutex
+	dirty map[string]bool // paths changed since the last rehash
+	kick  chan struct{}   // a path was marked dirty
+	done  chan struct{}
+
+	notify *inotify // nil when polling
+}
+
+// Watchers running, to find the one of a file
+var watchersMutex sync.Mutex
+var watchers = map[*ShareWatcher]bool{}
+
+// Start watching the shares whose tree is root (as built by Merkelify or MerkelifyShares)
+func WatchShare(root Node) *ShareWatcher {
+	w := &ShareWatcher{
+		paths:   sharePaths(root),
+		root:    root,
+		changed: make(chan Node, 1),
+		dirty:   map[string]bool{},
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	notify, err := newInotify()
+	for _, path := range w.paths {
+		if err == nil {
+			err = notify.addTree(path, "", rootIgnoreRules())
+			if err != nil {
+				notify.close()
+			}
+		}
+	}
+	if err != nil {
+		UnexpectedMessage(fmt.Sprintf("Watching %s by scanning every %v (inotify: %v)", w.name(), WATCH_POLL, err))
+		go w.poll(w.scan())
+	} else {
+		w.notify = notify
+		go w.readInotify()
+	}
+	go w.run()
+
+	watchersMutex.Lock()
+	watchers[w] = true
+	watchersMutex.Unlock()
+	return w
+}
+
+// Paths of the shares watched, for messages
+func (w *ShareWatcher) name() string {
+	return strings.Join(w.paths, ", ")
+}
+
+// New trees, after each change of the shares. Only the latest one is kept if they are not received.
+func (w *ShareWatcher) Changed() <-chan Node {
+	return w.changed
+}
+
+// Stop watching
+func (w *ShareWatcher) Close() {
+	watchersMutex.Lock()
+	delete(watchers, w)
+	watchersMutex.Unlock()
+
+	close(w.done)
+	if w.notify != nil {
+		w.notify.close()
+	}
+}
+
+// Record that path was modified, created or deleted
+func (w *ShareWatcher) mark(path string) {
+	w.mutex.Lock()
+	w.dirty[path] = true
+	w.mutex.Unlock()
+
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// A shared file was found different from its hashes while serving it:
+// forget its cached hashes (size and mtime may not have changed) and have it rehashed by the watcher of its share
+func fileChanged(path string) {
+	forgetHashes(path)
+
+	watchersMutex.Lock()
+	defer watchersMutex.Unlock()
+	for w := range watchers {
+		for _, share := range w.paths {
+			if path == share || strings.HasPrefix(path, share+"/") {
+				w.markStale(path)
+				break
+			}
+		}
+	}
+}
+
+// Like mark, but a file already waiting to be rehashed doesn't delay the rehash,
+// so that requests for its chunks can't keep postponing it
+func (w *ShareWatcher) markStale(path string) {
+	w.mutex.Lock()
+	already := w.dirty[path]
+	w.dirty[path] = true
+	w.mutex.Unlock()
+
+	if already {
+		return
+	}
+	UnexpectedMessage(fmt.Sprintf("%s changed since it was hashed, rehashing it", path))
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Rehash once changes have settled for WATCH_DELAY
+func (w *ShareWatcher) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.kick:
+		}
+
+		timer := time.NewTimer(WATCH_DELAY)
+	settle:
+		for {
+			select {
+			case <-w.done:
+				timer.Stop()
+				return
+			case <-w.kick:
+				timer.Reset(WATCH_DELAY)
+			case <-timer.C:
+				break settle
+			}
+		}
+
+		w.mutex.Lock()
+		dirty := make([]string, 0, len(w.dirty))
+		for p := range w.dirty {
+			dirty = append(dirty, p)
+		}
+		w.dirty = map[string]bool{}
+		w.mutex.Unlock()
+
+		sort.Strings(dirty)
+		if LOG_PRINT_DATA {
+			fmt.Printf("Rehashing %v\n", dirty)
+		}
+
+		root := Rehash(w.root, dirty)
+		if bytes.Equal(root.Hash, w.root.Hash) {
+			continue
+		}
+		w.root = root
+		fmt.Printf("Share %s changed, new root %x\n", w.name(), root.Hash)
+
+		// replace the tree not received yet, if any
+		select {
+		case <-w.changed:
+		default:
+		}
+		w.changed <- root
+	}
+}
+
+func (w *ShareWatcher) readInotify() {
+	for {
+		path, isDir, created, err := w.notify.read()
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				HandlePanicError(err, "ShareWatcher: inotify")
+			}
+			return
+		}
+		if path == "" { // events were lost
+			for _, share := range w.paths {
+				w.mark(share)
+			}
+			continue
+		}
+		switch {
+		case gopath.Base(path) == IGNORE_FILE:
+			// directories it stops ignoring must be watched, what it ignores now is rehashed away
+			err = w.watchTree(gopath.Dir(path))
+			HandlePanicError(err, "ShareWatcher: watch "+gopath.Dir(path))
+		case w.ignored(path, isDir):
+			continue
+		case isDir && created:
+			// watch the new directory, and what may have been created in it already
+			err = w.watchTree(path)
+			HandlePanicError(err, "ShareWatcher: watch "+path)
+		}
+		w.mark(path)
+	}
+}
+
+// Watch directory path of a share, and the directories below it the ignore rules don't leave out
+func (w *ShareWatcher) watchTree(path string) error {
+	for _, share := range w.paths {
+		if path == share {
+			return w.notify.addTree(path, "", rootIgnoreRules())
+		}
+	}
+	parent, rel := w.dirRules(gopath.Dir(path))
+	if parent == nil {
+		return nil
+	}
+	rel = gopath.Join(rel, gopath.Base(path))
+	if parent.Ignored(rel, true) {
+		return nil
+	}
+	return w.notify.addTree(path, rel, parent)
+}
+
+// Rules for the entries of directory dir of a share watched, and dir relative to its share
+// Return: nil rules if dir is not in a share, or is ignored or below an ignored directory
+func (w *ShareWatcher) dirRules(dir string) (*ignoreRules, string) {
+	for _, share := range w.paths {
+		if dir != share && !strings.HasPrefix(dir, share+"/") {
+			continue
+		}
+		rules := rootIgnoreRules().forDir(share, "")
+		rel := ""
+		for _, name := range strings.Split(dir[len(share):], "/") {
+			if name == "" {
+				continue
+			}
+			rel = gopath.Join(rel, name)
+			if rules.Ignored(rel, true) {
+				return nil, rel
+			}
+			rules = rules.forDir(share+"/"+rel, rel)
+		}
+		return rules, rel
+	}
+	return nil, ""
+}
+
+// Is path left out of its share by the ignore rules, as hashDir would leave it out
+func (w *ShareWatcher) ignored(path string, isDir bool) bool {
+	for _, share := range w.paths {
+		if path == share {
+			return false
+		}
+	}
+	rules, rel := w.dirRules(gopath.Dir(path))
+	if rules == nil {
+		return true
+	}
+	return rules.Ignored(gopath.Join(rel, gopath.Base(path)), isDir)
+}
+
+// State of a path seen by the scan
+type fileStamp struct {
+	size  int64
+	mtime time.Time
+	isDir bool
+}
+
+// Scan the shares every WATCH_POLL and mark what differs from the previous scan
+func (w *ShareWatcher) poll(previous map[string]fileStamp) {
+	ticker := time.NewTicker(WATCH_POLL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		current := w.scan()
+		for path, stamp := range current {
+			if old, ok := previous[path]; !ok || (!stamp.isDir && old != stamp) || old.isDir != stamp.isDir {
+				w.mark(path)
+			}
+		}
+		for path := range previous {
+			if _, ok := current[path]; !ok {
+				w.mark(path)
+			}
+		}
+		previous = current
+	}
+}
+
+// Stamps of everything in the shares watched
+func (w *ShareWatcher) scan() map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	for _, path := range w.paths {
+		for p, stamp := range scanShare(path) {
+			stamps[p] = stamp
+		}
+	}
+	return stamps
+}
+
+// Stamps of everything in the share the ignore rules don't leave out (ignore files always),
+// with paths written as hashDir writes them
+func scanShare(path string) map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	var scan func(path string, rel string, parent *ignoreRules)
+	scan = func(path string, rel string, parent *ignoreRules) {
+		info, err := os.Lstat(path) // links are not followed, as inotify doesn't
+		if err != nil {
+			return
+		}
+		if rel != "" && gopath.Base(rel) != IGNORE_FILE && parent.Ignored(rel, info.IsDir()) {
+			return
+		}
+		stamps[path] = fileStamp{info.Size(), info.ModTime(), info.IsDir()}
+		if !info.IsDir() {
+			return
+		}
+		rules := parent.forDir(path, rel)
+		dir, _ := os.ReadDir(path)
+		for _, de := range dir {
+			scan(path+"/"+de.Name(), gopath.Join(rel, de.Name()), rules)
+		}
+	}
+	scan(path, "", rootIgnoreRules())
+	return stamps
+}
@@ -0,0 +1,129 @@
+package moduls
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A share with a split directory, for the tests of Rehash
+func watchedShare(t *testing.T) string {
+	files := map[string][]byte{"a": []byte("a"), "sub/b": testContent(3 * CHUNK_SIZE)}
+	for i := 0; i < 40; i++ {
+		files[fmt.Sprintf("sub/big/f%02d", i)] = []byte(fmt.Sprint(i))
+	}
+	return writeShare(t, files)
+}
+
+// Rehashing only the paths that changed gives the tree of a full build
+func TestRehash(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(share string) []string // return: the paths changed
+	}{
+		{"nothing", func(share string) []string { return nil }},
+		{"file modified", func(share string) []string {
+			os.WriteFile(filepath.Join(share, "sub", "big", "f07"), []byte("changed"), 0644)
+			return []string{share + "/sub/big/f07"}
+		}},
+		{"file created", func(share string) []string {
+			os.WriteFile(filepath.Join(share, "sub", "big", "new"), testContent(50000), 0644)
+			return []string{share + "/sub/big/new"}
+		}},
+		{"file deleted", func(share string) []string {
+			os.Remove(filepath.Join(share, "sub", "big", "f03"))
+			return []string{share + "/sub/big/f03"}
+		}},
+		{"directories created", func(share string) []string {
+			os.MkdirAll(filepath.Join(share, "n1", "n2"), 0755)
+			os.WriteFile(filepath.Join(share, "n1", "n2", "x"), []byte("x"), 0644)
+			return []string{share + "/n1"}
+		}},
+		{"directory moved", func(share string) []string {
+			os.Rename(filepath.Join(share, "sub", "big"), filepath.Join(share, "moved"))
+			return []string{share + "/sub/big", share + "/moved"}
+		}},
+		{"directory removed", func(share string) []string {
+			os.RemoveAll(filepath.Join(share, "sub"))
+			return []string{share + "/sub"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			share := watchedShare(t)
+			old := Merkelify(share)
+			rehashed := Rehash(old, tt.change(share))
+			if full := Merkelify(share); !bytes.Equal(rehashed.Hash, full.Hash) {
+				t.Errorf("rehashed root %x, full build %x", rehashed.Hash, full.Hash)
+			}
+		})
+	}
+}
+
+// A change in the share is seen, and the new tree served and sent on Changed
+func TestWatchShare(t *testing.T) {
+	share := watchedShare(t)
+	w := WatchShare(Merkelify(share))
+	defer w.Close()
+
+	os.WriteFile(filepath.Join(share, "sub", "big", "f07"), []byte("changed"), 0644)
+	select {
+	case root := <-w.Changed():
+		if value, _ := SharedIndex().Lookup(root.Hash); value == nil {
+			t.Error("new tree not served")
+		}
+		if full := Merkelify(share); !bytes.Equal(root.Hash, full.Hash) {
+			t.Errorf("new root %x, full build %x", root.Hash, full.Hash)
+		}
+	case <-time.After(WATCH_POLL + 5*time.Second):
+		t.Fatal("change not seen")
+	}
+}
+
+// Changes in what the ignore rules leave out are not seen, until an ignore file stops leaving it out
+func TestWatchShareIgnores(t *testing.T) {
+	defer func(patterns []string) { ExcludePatterns = patterns }(ExcludePatterns)
+	ExcludePatterns = []string{".git/"}
+	share := writeShare(t, map[string][]byte{
+		"a":             []byte("a"),
+		".git/objects/": nil,
+		"build/":        nil,
+		IGNORE_FILE:     []byte("build/\n"),
+	})
+	w := WatchShare(Merkelify(share))
+	defer w.Close()
+	changed := func(what string) {
+		t.Helper()
+		select {
+		case root := <-w.Changed():
+			if want, _ := build(share); !bytes.Equal(root.Hash, want.Hash) {
+				t.Fatalf("%s: rehashed root %x, built %x", what, root.Hash, want.Hash)
+			}
+		case <-time.After(WATCH_POLL + 5*time.Second):
+			t.Fatalf("%s: change not seen", what)
+		}
+	}
+
+	os.WriteFile(filepath.Join(share, ".git", "objects", "x"), []byte("x"), 0644)
+	os.MkdirAll(filepath.Join(share, "build", "out"), 0755)
+	os.WriteFile(filepath.Join(share, "build", "o"), []byte("o"), 0644)
+	select {
+	case <-w.Changed():
+		t.Fatal("rehashed for ignored files")
+	case <-time.After(3 * WATCH_DELAY):
+	}
+	for path := range scanShare(share) {
+		if strings.Contains(path, "/.git/") || strings.Contains(path, "/build/") {
+			t.Errorf("%s scanned", path)
+		}
+	}
+
+	os.WriteFile(filepath.Join(share, IGNORE_FILE), nil, 0644)
+	changed("build no longer ignored")
+	os.WriteFile(filepath.Join(share, "build", "out", "z"), []byte("z"), 0644)
+	changed("file in build")
+}